@@ -0,0 +1,291 @@
+// Package client talks to a commit log served by package server and implements commitlog.Log,
+// so that the same code runs against an embedded or a remote log.
+//
+//      c, err := client.New("http://localhost:8080", nil)
+//      offset, err := c.Append([]byte(`data`))
+//
+// Connections are kept alive and reused. Failed requests are retried with a backoff,
+// reads on any transport error or 502, 503 and 504, appends only when the connection could
+// not be established, so that a retry never appends a record twice.
+package client
+
+import (
+        "bytes"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "net"
+        "net/http"
+        "net/url"
+        "strings"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+        "github.com/HoMuChen/commitlog/server"
+)
+
+const (
+        DefaultRetries = 3
+        DefaultRetryBackoff = 100 * time.Millisecond
+        DefaultTimeout = 10 * time.Second
+        DefaultPageSize = 1000
+)
+
+var (
+        ErrorInvalidAddress = errors.New("Invalid server address")
+
+        // errors of the log recognized in responses, the client returns the same values as an embedded log
+        knownErrors = []error{
+                commitlog.ErrorRecordNotFound,
+                commitlog.ErrorRecordCompacted,
+                commitlog.ErrorSegmentNotFound,
+                commitlog.ErrorEmptyBatch,
+                commitlog.ErrorClosed,
+                commitlog.ErrorExceedMaxRecordSize,
+                commitlog.ErrorAckTimeout,
+        }
+)
+
+var _ commitlog.Log = (*Client)(nil)
+
+type Options struct {
+        Retries         int             // retries after a failed attempt, negative for none
+        RetryBackoff    time.Duration   // wait before the first retry, doubled for every further one
+        Timeout         time.Duration   // of a single attempt, tails are not limited
+        PageSize        int             // records fetched at once by Scan
+}
+
+func NewDefaultOptions() *Options {
+        return &Options{
+                Retries:        DefaultRetries,
+                RetryBackoff:   DefaultRetryBackoff,
+                Timeout:        DefaultTimeout,
+                PageSize:       DefaultPageSize,
+        }
+}
+
+func (o *Options) withDefaults() *Options {
+        options := *o
+        if options.Retries == 0 {
+                options.Retries = DefaultRetries
+        }
+        if options.Retries < 0 {
+                options.Retries = 0
+        }
+        if options.RetryBackoff == 0 {
+                options.RetryBackoff = DefaultRetryBackoff
+        }
+        if options.Timeout == 0 {
+                options.Timeout = DefaultTimeout
+        }
+        if options.PageSize == 0 {
+                options.PageSize = DefaultPageSize
+        }
+
+        return &options
+}
+
+type Client struct {
+        addr            string
+        options         *Options
+        transport       *http.Transport
+        http            *http.Client    // requests limited by Options.Timeout
+        stream          *http.Client    // tails
+}
+
+// New returns a client of the server at addr, like http://localhost:8080.
+func New(addr string, options *Options) (*Client, error) {
+        if options == nil {
+                options = NewDefaultOptions()
+        }
+
+        u, err := url.Parse(addr)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+                return nil, ErrorInvalidAddress
+        }
+
+        options = options.withDefaults()
+        transport := http.DefaultTransport.(*http.Transport).Clone()
+        transport.MaxIdleConnsPerHost = 16
+
+        return &Client{
+                addr:           strings.TrimSuffix(addr, "/"),
+                options:        options,
+                transport:      transport,
+                http:           &http.Client{Transport: transport, Timeout: options.Timeout},
+                stream:         &http.Client{Transport: transport},
+        }, nil
+}
+
+func (c *Client) Append(data []byte) (int, error) {
+        return c.AppendRecord(&commitlog.Record{Value: data})
+}
+
+func (c *Client) AppendRecord(rec *commitlog.Record) (int, error) {
+        var resp server.AppendResponse
+        if err := c.do(http.MethodPost, "/records", server.FromRecord(rec), &resp); err != nil {
+                return 0, err
+        }
+
+        return resp.Offset, nil
+}
+
+func (c *Client) AppendBatch(data [][]byte) (int, int, error) {
+        recs := make([]*commitlog.Record, len(data))
+        for i := range data {
+                recs[i] = &commitlog.Record{Value: data[i]}
+        }
+
+        return c.AppendRecords(recs)
+}
+
+func (c *Client) AppendRecords(recs []*commitlog.Record) (int, int, error) {
+        req := server.BatchRequest{Records: make([]server.Record, len(recs))}
+        for i := range recs {
+                req.Records[i] = server.FromRecord(recs[i])
+        }
+
+        var resp server.BatchResponse
+        if err := c.do(http.MethodPost, "/records/batch", req, &resp); err != nil {
+                return 0, 0, err
+        }
+
+        return resp.First, resp.Last, nil
+}
+
+func (c *Client) Read(offset int) ([]byte, error) {
+        rec, err := c.ReadRecord(offset)
+        if err != nil {
+                return nil, err
+        }
+
+        return rec.Value, nil
+}
+
+func (c *Client) ReadRecord(offset int) (*commitlog.Record, error) {
+        var rec server.Record
+        if err := c.do(http.MethodGet, fmt.Sprintf("/records/%d", offset), nil, &rec); err != nil {
+                return nil, err
+        }
+
+        return server.ToRecord(rec), nil
+}
+
+// Offset returns the last offset of the log.
+func (c *Client) Offset() (int, error) {
+        var resp server.OffsetResponse
+        if err := c.do(http.MethodGet, "/offset", nil, &resp); err != nil {
+                return 0, err
+        }
+
+        return resp.Offset, nil
+}
+
+func (c *Client) OffsetForTime(tm time.Time) (int, error) {
+        var resp server.OffsetResponse
+        if err := c.do(http.MethodGet, "/offset?time=" + url.QueryEscape(tm.Format(time.RFC3339Nano)), nil, &resp); err != nil {
+                return 0, err
+        }
+
+        return resp.Offset, nil
+}
+
+// Close drops the idle connections, the remote log is left open.
+func (c *Client) Close() error {
+        c.transport.CloseIdleConnections()
+
+        return nil
+}
+
+// do sends a request with retries and decodes the JSON response into v.
+func (c *Client) do(method, path string, body interface{}, v interface{}) error {
+        var data []byte
+        if body != nil {
+                var err error
+                if data, err = json.Marshal(body); err != nil {
+                        return err
+                }
+        }
+
+        backoff := c.options.RetryBackoff
+        for attempt := 0; ; attempt++ {
+                resp, err := c.send(method, path, data)
+                if err == nil {
+                        err = decodeResponse(resp, v)
+                        if err == nil {
+                                return nil
+                        }
+                }
+
+                if attempt >= c.options.Retries || !retryable(method, resp, err) {
+                        return err
+                }
+
+                time.Sleep(backoff)
+                backoff *= 2
+        }
+}
+
+func (c *Client) send(method, path string, data []byte) (*http.Response, error) {
+        req, err := http.NewRequest(method, c.addr + path, bytes.NewReader(data))
+        if err != nil {
+                return nil, err
+        }
+        if data != nil {
+                req.Header.Set("Content-Type", "application/json")
+        }
+
+        return c.http.Do(req)
+}
+
+// decodeResponse decodes a successful response into v or returns the error of the server.
+func decodeResponse(resp *http.Response, v interface{}) error {
+        defer resp.Body.Close()
+
+        if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+                return json.NewDecoder(resp.Body).Decode(v)
+        }
+
+        var body server.ErrorResponse
+        if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+                // drained so that the connection can be reused
+                io.Copy(ioutil.Discard, resp.Body)
+                return fmt.Errorf("Unexpected status: %s", resp.Status)
+        }
+
+        return toError(body.Error)
+}
+
+func toError(message string) error {
+        for _, err := range knownErrors {
+                if err.Error() == message {
+                        return err
+                }
+        }
+
+        return errors.New(message)
+}
+
+// retryable tells whether an attempt is worth repeating. Appends are only repeated when
+// they cannot have reached the server.
+func retryable(method string, resp *http.Response, err error) bool {
+        var opErr *net.OpError
+        if errors.As(err, &opErr) && opErr.Op == "dial" {
+                return true
+        }
+        if method != http.MethodGet {
+                return false
+        }
+        if resp == nil {
+                return true
+        }
+
+        switch resp.StatusCode {
+        case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+                return true
+        }
+
+        return false
+}
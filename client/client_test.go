@@ -0,0 +1,165 @@
+package client
+
+import (
+        "context"
+        "net/http/httptest"
+        "os"
+        "testing"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+        "github.com/HoMuChen/commitlog/server"
+)
+
+func newTestClient(t *testing.T) (*commitlog.CommitLog, *httptest.Server, *Client) {
+        cl, err := commitlog.New("test.db", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        srv := httptest.NewServer(server.New(cl))
+        c, err := New(srv.URL, &Options{RetryBackoff: time.Millisecond, PageSize: 2})
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        return cl, srv, c
+}
+
+func cleanup(cl *commitlog.CommitLog, srv *httptest.Server, c *Client) {
+        c.Close()
+        srv.Close()
+        cl.Close()
+        os.RemoveAll(cl.Path)
+}
+
+// exercise runs against both an embedded and a remote log
+func exercise(t *testing.T, log commitlog.Log) {
+        if offset, err := log.AppendRecord(&commitlog.Record{Key: []byte(`k`), Value: []byte(`a`), Headers: []commitlog.Header{{Key: "h", Value: "v"}}}); err != nil || offset != 0 {
+                t.Errorf("Expect offset 0 but got: %v, %v", offset, err)
+        }
+        if first, last, err := log.AppendBatch([][]byte{[]byte(`b`), []byte(`c`), []byte(`d`)}); err != nil || first != 1 || last != 3 {
+                t.Errorf("Expect offsets 1 to 3 but got: %v, %v, %v", first, last, err)
+        }
+
+        if rec, err := log.ReadRecord(0); err != nil || string(rec.Key) != `k` || string(rec.Value) != `a` || len(rec.Headers) != 1 {
+                t.Errorf("Expect to read back the record but got: %+v, %v", rec, err)
+        }
+        if _, err := log.Read(10); err != commitlog.ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+        if _, _, err := log.AppendBatch(nil); err != commitlog.ErrorEmptyBatch {
+                t.Errorf("Expect ErrorEmptyBatch but got: %v", err)
+        }
+
+        it := log.Scan(1)
+        values := ""
+        for it.Next() {
+                values += string(it.Record().Value)
+        }
+        if values != `bcd` || it.Err() != nil {
+                t.Errorf("Expect bcd but got: %v, %v", values, it.Err())
+        }
+        log.Append([]byte(`e`))
+        if !it.Next() || string(it.Record().Value) != `e` {
+                t.Errorf("Expect the iterator to pick up the new record")
+        }
+        it.Close()
+
+        ctx, cancel := context.WithCancel(context.Background())
+        sub := log.Tail(ctx, 3)
+        for _, value := range []string{`d`, `e`} {
+                if !sub.Next() || string(sub.Record().Value) != value {
+                        t.Errorf("Expect %v but got: %v", value, sub.Err())
+                }
+        }
+        go func() {
+                time.Sleep(10 * time.Millisecond)
+                log.Append([]byte(`f`))
+        }()
+        if !sub.Next() || string(sub.Record().Value) != `f` {
+                t.Errorf("Expect the tail to wait for f but got: %v", sub.Err())
+        }
+        cancel()
+        if sub.Next() || sub.Err() != context.Canceled {
+                t.Errorf("Expect context.Canceled but got: %v", sub.Err())
+        }
+        sub.Close()
+}
+
+func TestEmbedded(t *testing.T) {
+        cl, err := commitlog.New("test.db", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer func() {
+                cl.Close()
+                os.RemoveAll(cl.Path)
+        }()
+
+        exercise(t, cl)
+}
+
+func TestRemote(t *testing.T) {
+        cl, srv, c := newTestClient(t)
+        defer cleanup(cl, srv, c)
+
+        exercise(t, c)
+
+        if offset, err := c.Offset(); err != nil || offset != 5 {
+                t.Errorf("Expect last offset 5 but got: %v, %v", offset, err)
+        }
+}
+
+func TestTailReconnect(t *testing.T) {
+        cl, srv, c := newTestClient(t)
+        defer cleanup(cl, srv, c)
+
+        cl.Append([]byte(`a`))
+
+        sub := c.Tail(context.Background(), 0)
+        defer sub.Close()
+        if !sub.Next() || string(sub.Record().Value) != `a` {
+                t.Errorf("Expect a but got: %v", sub.Err())
+        }
+
+        srv.CloseClientConnections()
+        cl.Append([]byte(`b`))
+
+        if !sub.Next() || string(sub.Record().Value) != `b` || sub.Record().Offset != 1 {
+                t.Errorf("Expect to resume with b but got: %v", sub.Err())
+        }
+
+        cl.Close()
+        if sub.Next() || sub.Err() != commitlog.ErrorClosed {
+                t.Errorf("Expect ErrorClosed but got: %v", sub.Err())
+        }
+}
+
+func TestRetry(t *testing.T) {
+        cl, srv, c := newTestClient(t)
+        defer cleanup(cl, srv, c)
+
+        if _, err := New("localhost:8080", nil); err != ErrorInvalidAddress {
+                t.Errorf("Expect ErrorInvalidAddress but got: %v", err)
+        }
+
+        down, err := New("http://127.0.0.1:1", &Options{Retries: 2, RetryBackoff: time.Millisecond})
+        if err != nil {
+                t.Fatal(err)
+        }
+        start := time.Now()
+        if _, err := down.Append([]byte(`a`)); err == nil {
+                t.Errorf("Expect an error from a server which is down")
+        }
+        if elapsed := time.Since(start); elapsed < 3 * time.Millisecond {
+                t.Errorf("Expect two retries with backoff but took: %v", elapsed)
+        }
+
+        // a client of a live server is unaffected
+        c.Append([]byte(`a`))
+        c.Append([]byte(`b`))
+        if data, err := c.Read(1); err != nil || string(data) != `b` {
+                t.Errorf("Expect b but got: %s, %v", data, err)
+        }
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+        "bufio"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+        "github.com/HoMuChen/commitlog/server"
+)
+
+// scanner reads pages of records, like commitlog.Iterator Next returns false at the end
+// of the log and can be called again later on to pick up new records.
+type scanner struct {
+        c               *Client
+        next            int     // offset of the next page
+        page            []server.Record
+        rec             *commitlog.Record
+        err             error
+        closed          bool
+}
+
+// Scan reads the records from an offset onwards, Options.PageSize at a time.
+func (c *Client) Scan(offset int) commitlog.Cursor {
+        return &scanner{
+                c:              c,
+                next:           offset,
+        }
+}
+
+func (s *scanner) Next() bool {
+        if s.err != nil || s.closed {
+                return false
+        }
+
+        if len(s.page) == 0 {
+                var resp server.RangeResponse
+                path := fmt.Sprintf("/records?from=%d&limit=%d", s.next, s.c.options.PageSize)
+                if err := s.c.do(http.MethodGet, path, nil, &resp); err != nil {
+                        s.err = err
+                        return false
+                }
+                if len(resp.Records) == 0 {
+                        return false
+                }
+                s.page = resp.Records
+        }
+
+        s.rec = server.ToRecord(s.page[0])
+        s.page = s.page[1:]
+        s.next = s.rec.Offset + 1
+
+        return true
+}
+
+func (s *scanner) Record() *commitlog.Record {
+        return s.rec
+}
+
+func (s *scanner) Err() error {
+        return s.err
+}
+
+func (s *scanner) Close() error {
+        s.closed = true
+        s.page = nil
+
+        return nil
+}
+
+// tail reads the event stream of GET /tail and reconnects from the last received offset
+// when the connection breaks.
+type tail struct {
+        c               *Client
+        ctx             context.Context
+        next            int     // offset to resume from
+        body            io.ReadCloser
+        r               *bufio.Reader
+        failures        int     // attempts in a row which yielded no record
+        rec             *commitlog.Record
+        err             error
+        closed          bool
+}
+
+// Tail reads the records from an offset onwards and then waits for new appends, until ctx is done.
+func (c *Client) Tail(ctx context.Context, offset int) commitlog.Cursor {
+        return &tail{
+                c:              c,
+                ctx:            ctx,
+                next:           offset,
+        }
+}
+
+func (t *tail) Next() bool {
+        for t.err == nil && !t.closed {
+                if t.r == nil {
+                        if err := t.connect(); err != nil {
+                                t.retry(err)
+                                continue
+                        }
+                }
+
+                event, data, err := t.readEvent()
+                if err != nil {
+                        t.disconnect()
+                        t.retry(err)
+                        continue
+                }
+
+                switch event {
+                case "error":
+                        var body server.ErrorResponse
+                        json.Unmarshal(data, &body)
+                        t.err = toError(body.Error)
+                case "", "message":
+                        var rec server.Record
+                        if err := json.Unmarshal(data, &rec); err != nil {
+                                t.err = err
+                                break
+                        }
+
+                        t.rec = server.ToRecord(rec)
+                        t.next = t.rec.Offset + 1
+                        t.failures = 0
+                        return true
+                }
+        }
+
+        t.disconnect()
+        return false
+}
+
+func (t *tail) connect() error {
+        req, err := http.NewRequestWithContext(t.ctx, http.MethodGet, fmt.Sprintf("%s/tail?from=%d", t.c.addr, t.next), nil)
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Accept", "text/event-stream")
+
+        resp, err := t.c.stream.Do(req)
+        if err != nil {
+                return err
+        }
+        if resp.StatusCode != http.StatusOK {
+                return decodeResponse(resp, nil)
+        }
+
+        t.body = resp.Body
+        t.r = bufio.NewReader(resp.Body)
+
+        return nil
+}
+
+func (t *tail) disconnect() {
+        if t.body != nil {
+                t.body.Close()
+                t.body = nil
+                t.r = nil
+        }
+}
+
+// retry sets the error once the context is done or the retries are used up, and waits otherwise.
+func (t *tail) retry(err error) {
+        if ctxErr := t.ctx.Err(); ctxErr != nil {
+                t.err = ctxErr
+                return
+        }
+        if t.failures >= t.c.options.Retries {
+                t.err = err
+                return
+        }
+
+        backoff := t.c.options.RetryBackoff << uint(t.failures)
+        t.failures++
+
+        select {
+        case <- time.After(backoff):
+        case <- t.ctx.Done():
+                t.err = t.ctx.Err()
+        }
+}
+
+// readEvent reads lines up to the blank line ending an event, comments and ids are skipped
+// as the offset is part of the record.
+func (t *tail) readEvent() (string, []byte, error) {
+        var event string
+        var data []byte
+
+        for {
+                line, err := t.r.ReadString('\n')
+                if err != nil {
+                        if err == io.EOF {
+                                err = io.ErrUnexpectedEOF
+                        }
+                        return "", nil, err
+                }
+                line = strings.TrimRight(line, "\r\n")
+
+                switch {
+                case line == "":
+                        if data != nil || event != "" {
+                                return event, data, nil
+                        }
+                case strings.HasPrefix(line, "event:"):
+                        event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+                case strings.HasPrefix(line, "data:"):
+                        data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+                }
+        }
+}
+
+func (t *tail) Record() *commitlog.Record {
+        return t.rec
+}
+
+func (t *tail) Err() error {
+        return t.err
+}
+
+func (t *tail) Close() error {
+        t.closed = true
+        t.disconnect()
+
+        return nil
+}
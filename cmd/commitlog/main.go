@@ -0,0 +1,336 @@
+// Command commitlog inspects and operates on log directories. It reads the segment files directly,
+// so it also works on a directory whose owning process is down.
+//
+//      commitlog segments -dir D                       list the segments
+//      commitlog dump -dir D [-from N] [-n N]          decode records from an offset on
+//      commitlog index -dir D -segment N               print the index and time index entries of a segment
+//      commitlog verify -dir D [-repair [-truncate]]   check the segments against their indexes, -repair rebuilds them
+//      commitlog tail -dir D [-n N] [-f]               print the last records, -f waits for new ones
+//      commitlog append -dir D [-key K] [-batch]       append every line of stdin as a record
+//
+// append opens the log and must not run while another process has it open.
+package main
+
+import (
+        "bufio"
+        "encoding/json"
+        "flag"
+        "fmt"
+        "os"
+        "text/tabwriter"
+        "time"
+        "unicode/utf8"
+
+        "github.com/HoMuChen/commitlog"
+)
+
+type command struct {
+        usage           string
+        run             func(args []string) error
+}
+
+var commands = map[string]command{
+        "segments":     {"list the segments with their base offsets, sizes and time ranges", segments},
+        "dump":         {"decode records from an offset on", dump},
+        "index":        {"print the index and time index entries of a segment", index},
+        "verify":       {"check the segments against their indexes, -repair rebuilds them", verify},
+        "tail":         {"print the last records, -f waits for new ones", tail},
+        "append":       {"append every line of stdin as a record", appendLines},
+}
+
+func main() {
+        if len(os.Args) < 2 {
+                usage()
+        }
+
+        cmd, ok := commands[os.Args[1]]
+        if !ok {
+                usage()
+        }
+
+        if err := cmd.run(os.Args[2:]); err != nil {
+                fmt.Fprintf(os.Stderr, "commitlog %s: %v\n", os.Args[1], err)
+                os.Exit(1)
+        }
+}
+
+func usage() {
+        fmt.Fprintf(os.Stderr, "usage: commitlog <command> -dir <dir> [flags]\n\n")
+        for _, name := range []string{"segments", "dump", "index", "verify", "tail", "append"} {
+                fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+        }
+        os.Exit(2)
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+        fs := flag.NewFlagSet(name, flag.ExitOnError)
+        dir := fs.String("dir", "commitlog.db", "directory of the segments")
+
+        return fs, dir
+}
+
+func segments(args []string) error {
+        fs, dir := newFlagSet("segments")
+        fs.Parse(args)
+
+        infos, err := commitlog.Segments(*dir, nil)
+        if err != nil {
+                return err
+        }
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "BASE\tVERSION\tKEY\tSIZE\tRECORDS\tOFFSETS\tFROM\tTO\tTORN")
+        for _, info := range infos {
+                key := "-"
+                if info.KeyID >= 0 {
+                        key = fmt.Sprint(info.KeyID)
+                }
+                fmt.Fprintf(w, "%d\tv%d\t%s\t%d\t%d\t%s\t%s\t%s\t%d\n", info.BaseOffset, info.Version, key, info.Size,
+                        info.Records, offsetRange(info), formatTime(info.FirstTime), formatTime(info.LastTime), info.TornBytes)
+        }
+
+        return w.Flush()
+}
+
+func dump(args []string) error {
+        fs, dir := newFlagSet("dump")
+        from := fs.Int("from", 0, "first offset")
+        n := fs.Int("n", 0, "records to print at most, zero for all")
+        fs.Parse(args)
+
+        count := 0
+        _, err := commitlog.ScanDir(*dir, *from, nil, func(rec *commitlog.Record) bool {
+                printRecord(rec)
+                count++
+                return *n <= 0 || count < *n
+        })
+
+        return err
+}
+
+func index(args []string) error {
+        fs, dir := newFlagSet("index")
+        segment := fs.Int("segment", 0, "base offset of the segment")
+        fs.Parse(args)
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+        entries, err := commitlog.IndexEntries(*dir, *segment)
+        if err != nil {
+                return err
+        }
+        fmt.Fprintln(w, "OFFSET\tPOSITION")
+        for _, entry := range entries {
+                fmt.Fprintf(w, "%d\t%d\n", entry.Offset, entry.Position)
+        }
+
+        timeEntries, err := commitlog.TimeIndexEntries(*dir, *segment)
+        if err != nil {
+                return err
+        }
+        fmt.Fprintln(w, "\nTIME\tOFFSET")
+        for _, entry := range timeEntries {
+                fmt.Fprintf(w, "%s\t%d\n", formatTime(entry.Time), entry.Offset)
+        }
+
+        return w.Flush()
+}
+
+func verify(args []string) error {
+        fs, dir := newFlagSet("verify")
+        repair := fs.Bool("repair", false, "cut off torn tails, rebuild broken indexes from the log files and remove orphan index files")
+        truncate := fs.Bool("truncate", false, "with -repair, cut log files at their first corrupted record instead of stepping over it")
+        keyCompaction := fs.Bool("key-compaction", false, "the log runs key compaction, gaps between segments are expected")
+        fs.Parse(args)
+
+        options := &commitlog.Options{KeyCompaction: *keyCompaction}
+
+        report, err := commitlog.Verify(*dir, options)
+        if err != nil {
+                return err
+        }
+        for _, issue := range report.Issues {
+                fmt.Println(issue)
+        }
+
+        if *repair && len(report.Issues) > 0 {
+                if _, err := commitlog.Repair(*dir, options, *truncate); err != nil {
+                        return err
+                }
+                if report, err = commitlog.Verify(*dir, options); err != nil {
+                        return err
+                }
+                fmt.Printf("repaired, %d issues left\n", len(report.Issues))
+                for _, issue := range report.Issues {
+                        fmt.Println(issue)
+                }
+        }
+
+        if len(report.Issues) > 0 {
+                return fmt.Errorf("%d issues in %d segments", len(report.Issues), len(report.Segments))
+        }
+        fmt.Printf("%d segments ok\n", len(report.Segments))
+
+        return nil
+}
+
+func tail(args []string) error {
+        fs, dir := newFlagSet("tail")
+        n := fs.Int("n", 10, "records to print before following")
+        follow := fs.Bool("f", false, "wait for new records")
+        interval := fs.Duration("interval", 500 * time.Millisecond, "time between two looks for new records with -f")
+        fs.Parse(args)
+
+        offsets, err := commitlog.SegmentOffsets(*dir)
+        if err != nil {
+                return err
+        }
+
+        // the last n records are searched for from the newest segment back, the time indexes hold an entry
+        // per record so that only the records from the n-th last on are decoded
+        from := 0
+        count := 0
+        for i := len(offsets) - 1; i >= 0 && count < *n; i-- {
+                from = offsets[i]
+                entries, err := commitlog.TimeIndexEntries(*dir, offsets[i])
+                if err != nil {
+                        continue
+                }
+                if len(entries) >= *n - count {
+                        from = entries[len(entries) - (*n - count)].Offset
+                }
+                count += len(entries)
+        }
+
+        recs := make([]*commitlog.Record, 0)
+        next, err := commitlog.ScanDir(*dir, from, nil, func(rec *commitlog.Record) bool {
+                recs = append(recs, rec)
+                return true
+        })
+        if err != nil {
+                return err
+        }
+        if len(recs) > *n {
+                recs = recs[len(recs) - *n:]
+        }
+        for _, rec := range recs {
+                printRecord(rec)
+        }
+
+        for *follow {
+                time.Sleep(*interval)
+
+                if next, err = commitlog.ScanDir(*dir, next, nil, func(rec *commitlog.Record) bool {
+                        printRecord(rec)
+                        return true
+                }); err != nil {
+                        return err
+                }
+        }
+
+        return nil
+}
+
+func appendLines(args []string) error {
+        fs, dir := newFlagSet("append")
+        key := fs.String("key", "", "key of the records")
+        batch := fs.Bool("batch", false, "append all lines as a single batch")
+        fs.Parse(args)
+
+        // the log is only open for the appends, retention is left to its owner
+        options := commitlog.NewDefaultOptions()
+        options.RetentionPolicy = -1
+        cl, err := commitlog.New(*dir, options)
+        if err != nil {
+                return err
+        }
+
+        recs := make([]*commitlog.Record, 0)
+        scanner := bufio.NewScanner(os.Stdin)
+        scanner.Buffer(make([]byte, 64 * 1024), commitlog.DefaultMaxRecordSize)
+        for scanner.Scan() {
+                rec := &commitlog.Record{Value: append([]byte(nil), scanner.Bytes()...)}
+                if *key != "" {
+                        rec.Key = []byte(*key)
+                }
+
+                if *batch {
+                        recs = append(recs, rec)
+                        continue
+                }
+
+                offset, err := cl.AppendRecord(rec)
+                if err != nil {
+                        cl.Close()
+                        return err
+                }
+                fmt.Println(offset)
+        }
+        if err := scanner.Err(); err != nil {
+                cl.Close()
+                return err
+        }
+
+        if *batch && len(recs) > 0 {
+                first, last, err := cl.AppendRecords(recs)
+                if err != nil {
+                        cl.Close()
+                        return err
+                }
+                fmt.Printf("%d-%d\n", first, last)
+        }
+
+        return cl.Close()
+}
+
+// printRecord prints a record as a JSON line, keys and values are strings when they are text and base64 otherwise
+func printRecord(rec *commitlog.Record) {
+        out := struct {
+                Offset          int                     `json:"offset"`
+                Timestamp       string                  `json:"timestamp,omitempty"`
+                Key             interface{}             `json:"key,omitempty"`
+                Headers         []commitlog.Header      `json:"headers,omitempty"`
+                Value           interface{}             `json:"value"`
+        }{
+                Offset:         rec.Offset,
+                Timestamp:      rec.Timestamp.Format(time.RFC3339Nano),
+                Key:            printable(rec.Key),
+                Headers:        rec.Headers,
+                Value:          printable(rec.Value),
+        }
+
+        data, _ := json.Marshal(out)
+        fmt.Println(string(data))
+}
+
+func printable(data []byte) interface{} {
+        if data == nil {
+                return nil
+        }
+        if !utf8.Valid(data) {
+                return data
+        }
+        for _, r := range string(data) {
+                if r < 0x20 && r != '\t' && r != '\n' {
+                        return data
+                }
+        }
+
+        return string(data)
+}
+
+func offsetRange(info *commitlog.SegmentInfo) string {
+        if info.Records == 0 {
+                return "-"
+        }
+
+        return fmt.Sprintf("%d-%d", info.FirstOffset, info.LastOffset)
+}
+
+func formatTime(tm time.Time) string {
+        if tm.IsZero() {
+                return ""
+        }
+
+        return tm.Format(time.RFC3339)
+}
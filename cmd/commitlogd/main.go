@@ -0,0 +1,92 @@
+// Command commitlogd serves a commit log over HTTP, see package server for the API.
+// Metrics are served in the Prometheus text format on /metrics and through expvar on /debug/vars.
+//
+//      commitlogd -dir /var/lib/commitlog -addr :8080
+package main
+
+import (
+        "context"
+        "expvar"
+        "flag"
+        "fmt"
+        "log"
+        "net"
+        "net/http"
+        "os"
+        "os/signal"
+        "syscall"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+        "github.com/HoMuChen/commitlog/metrics"
+        "github.com/HoMuChen/commitlog/server"
+)
+
+func main() {
+        dir := flag.String("dir", "commitlog.db", "directory of the segments")
+        addr := flag.String("addr", ":8080", "address to listen on")
+        maxSegmentSize := flag.Int("max-segment-size", commitlog.DefaultMaxSegmentSize, "bytes of a segment before the log rolls over")
+        retention := flag.Duration("retention", commitlog.DefaultRetentionPolicy, "how long records are kept, negative for forever")
+        sync := flag.String("sync", "never", "when appends are fsynced: never, append or interval")
+        syncInterval := flag.Duration("sync-interval", commitlog.DefaultSyncInterval, "time between two fsyncs with -sync interval")
+        flag.Parse()
+
+        options := commitlog.NewDefaultOptions()
+        options.MaxSegmentSize = *maxSegmentSize
+        options.RetentionPolicy = *retention
+        options.SyncInterval = *syncInterval
+
+        switch *sync {
+        case "never":
+                options.SyncPolicy = commitlog.SyncNever
+        case "append":
+                options.SyncPolicy = commitlog.SyncEveryAppend
+        case "interval":
+                options.SyncPolicy = commitlog.SyncInterval
+        default:
+                fmt.Fprintf(os.Stderr, "unknown sync policy: %s\n", *sync)
+                os.Exit(2)
+        }
+
+        cl, err := commitlog.New(*dir, options)
+        if err != nil {
+                log.Fatal(err)
+        }
+
+        if err := metrics.Publish("commitlog", cl); err != nil {
+                log.Fatal(err)
+        }
+
+        mux := http.NewServeMux()
+        mux.Handle("/", server.New(cl))
+        mux.Handle("/metrics", metrics.Handler(cl))
+        mux.Handle("/debug/vars", expvar.Handler())
+
+        // tails are streamed until shutdown begins
+        base, stop := context.WithCancel(context.Background())
+        srv := &http.Server{
+                Addr:           *addr,
+                Handler:        mux,
+                BaseContext:    func(net.Listener) context.Context { return base },
+        }
+        srv.RegisterOnShutdown(stop)
+
+        done := make(chan os.Signal, 1)
+        signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+        go func() {
+                <-done
+
+                ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+                defer cancel()
+                srv.Shutdown(ctx)
+        }()
+
+        log.Printf("serving %s on %s", *dir, *addr)
+        if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Fatal(err)
+        }
+
+        if err := cl.Close(); err != nil {
+                log.Fatal(err)
+        }
+}
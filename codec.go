@@ -0,0 +1,213 @@
+package commitlog
+
+import (
+        "bytes"
+        "compress/flate"
+        "compress/gzip"
+        "compress/zlib"
+        "encoding/binary"
+        "errors"
+        "io"
+        "io/ioutil"
+        "sync"
+)
+
+var (
+        ErrorUnknownCodec = errors.New("Unknown codec")
+        ErrorCodecRegistered = errors.New("Codec is already registered")
+        ErrorCodecReserved = errors.New("Codec id is reserved for built-in codecs")
+)
+
+// Codec compresses record batches. Its ID is stored with every batch it compressed,
+// so it has to stay the same for as long as such batches are around.
+type Codec interface {
+        ID() byte
+        Name() string
+        Compress(data []byte) ([]byte, error)
+        Decompress(data []byte) ([]byte, error)
+}
+
+// Built-in codecs, ids up to 15 are reserved for them
+const (
+        CodecNone  byte = 0
+        CodecGzip  byte = 1
+        CodecFlate byte = 2
+        CodecZlib  byte = 3
+
+        lastReservedCodec byte = 15
+)
+
+var (
+        GzipCodec Codec = &streamCodec{
+                id:     CodecGzip,
+                name:   "gzip",
+                writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+                reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+        }
+        FlateCodec Codec = &streamCodec{
+                id:     CodecFlate,
+                name:   "flate",
+                writer: func(w io.Writer) io.WriteCloser {
+                        fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+                        return fw
+                },
+                reader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+        }
+        ZlibCodec Codec = &streamCodec{
+                id:     CodecZlib,
+                name:   "zlib",
+                writer: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+                reader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+        }
+)
+
+var (
+        codecsMu sync.RWMutex
+        codecs = map[byte]Codec{
+                CodecGzip:      GzipCodec,
+                CodecFlate:     FlateCodec,
+                CodecZlib:      ZlibCodec,
+        }
+)
+
+// RegisterCodec makes a custom codec available to write and read batches with.
+// Its id must be above the reserved ones and must not be taken yet.
+func RegisterCodec(codec Codec) error {
+        if codec.ID() <= lastReservedCodec {
+                return ErrorCodecReserved
+        }
+
+        codecsMu.Lock()
+        defer codecsMu.Unlock()
+
+        if _, ok := codecs[codec.ID()]; ok {
+                return ErrorCodecRegistered
+        }
+        codecs[codec.ID()] = codec
+
+        return nil
+}
+
+func codecByID(id byte) (Codec, error) {
+        codecsMu.RLock()
+        defer codecsMu.RUnlock()
+
+        codec, ok := codecs[id]
+        if !ok {
+                return nil, ErrorUnknownCodec
+        }
+
+        return codec, nil
+}
+
+// streamCodec adapts the compress packages of the standard library.
+type streamCodec struct {
+        id              byte
+        name            string
+        writer          func(w io.Writer) io.WriteCloser
+        reader          func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (c *streamCodec) ID() byte {
+        return c.id
+}
+
+func (c *streamCodec) Name() string {
+        return c.name
+}
+
+func (c *streamCodec) Compress(data []byte) ([]byte, error) {
+        var buf bytes.Buffer
+
+        w := c.writer(&buf)
+        if _, err := w.Write(data); err != nil {
+                return nil, err
+        }
+        if err := w.Close(); err != nil {
+                return nil, err
+        }
+
+        return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(data []byte) ([]byte, error) {
+        r, err := c.reader(bytes.NewReader(data))
+        if err != nil {
+                return nil, err
+        }
+        defer r.Close()
+
+        return ioutil.ReadAll(r)
+}
+
+// Compressed batch, a v3 record with the attrCompressed attribute set
+// + ------------------------------------------------------------------------- +
+// | Offset Delta: the one of the last record of the batch                     |
+// | Timestamp: the one of the last record of the batch                        |
+// | Value: | Codec ID (1B) | v3 records of the batch, compressed by the codec |
+// + ------------------------------------------------------------------------- +
+// The records inside keep their own offsets, which need not follow each other after compaction.
+// compressBatch returns the record standing for the batch, with the offset of its last record.
+func compressBatch(codec Codec, recs []*Record, baseOffset int) (*Record, error) {
+        data := make([]byte, 0)
+        for _, rec := range recs {
+                inner := *rec
+                inner.attributes = 0
+                data = append(data, encodeRecordV3(&inner, rec.Offset - baseOffset)...)
+        }
+
+        compressed, err := codec.Compress(data)
+        if err != nil {
+                return nil, err
+        }
+
+        last := recs[len(recs)-1]
+        wrapper := &Record{
+                Offset:         last.Offset,
+                Timestamp:      last.Timestamp,
+                Value:          append([]byte{codec.ID()}, compressed...),
+                attributes:     attrCompressed,
+        }
+
+        return wrapper, nil
+}
+
+// decodeCompressedBatch returns the records of a compressed batch, ok is false when they are corrupted.
+func decodeCompressedBatch(wrapper *Record, baseOffset int) ([]*Record, bool, error) {
+        if len(wrapper.Value) == 0 {
+                return nil, false, nil
+        }
+
+        codec, err := codecByID(wrapper.Value[0])
+        if err != nil {
+                return nil, false, err
+        }
+
+        data, err := codec.Decompress(wrapper.Value[1:])
+        if err != nil {
+                return nil, false, nil
+        }
+
+        recs := make([]*Record, 0)
+        for len(data) > 0 {
+                if len(data) < recordV3HeaderSize {
+                        return nil, false, nil
+                }
+
+                size := recordV3HeaderSize + int(binary.LittleEndian.Uint32(data[:4]))
+                if size > len(data) {
+                        return nil, false, nil
+                }
+
+                rec, ok := decodeRecordV3(data[:size], baseOffset)
+                if !ok {
+                        return nil, false, nil
+                }
+                rec.codec = codec.ID()
+
+                recs = append(recs, rec)
+                data = data[size:]
+        }
+
+        return recs, len(recs) > 0, nil
+}
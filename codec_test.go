@@ -0,0 +1,203 @@
+package commitlog
+
+import (
+        "bytes"
+        "fmt"
+        "os"
+        "testing"
+        "time"
+)
+
+func TestCodecs(t *testing.T) {
+        for _, codec := range []Codec{GzipCodec, FlateCodec, ZlibCodec} {
+                data := bytes.Repeat([]byte(`{"event":"click"}`), 10)
+
+                compressed, err := codec.Compress(data)
+                if err != nil {
+                        t.Error(err)
+                }
+                if len(compressed) >= len(data) {
+                        t.Errorf("Expect %v to compress %v bytes but got: %v", codec.Name(), len(data), len(compressed))
+                }
+
+                decompressed, err := codec.Decompress(compressed)
+                if err != nil || !bytes.Equal(data, decompressed) {
+                        t.Errorf("Expect %v to decompress back but got: %v", codec.Name(), err)
+                }
+        }
+}
+
+func TestAppendCompressedBatch(t *testing.T) {
+        options := &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Codec: GzipCodec}
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        batch := make([][]byte, 10)
+        for i := range batch {
+                batch[i] = []byte(fmt.Sprintf(`{"event":"click","id":%d}`, i))
+        }
+        cl.AppendBatch(batch)
+        cl.AppendBatch(batch[:5])
+
+        fi, _ := os.Stat(cl.curSegment.path)
+        if fi.Size() >= 15 * int64(len(batch[0])) {
+                t.Errorf("Expect the log file to be compressed but got %v bytes", fi.Size())
+        }
+
+        for i := 0; i < 15; i++ {
+                if data, err := cl.Read(i); err != nil || !bytes.Equal(batch[i % 10], data) {
+                        t.Errorf("Expect %s at offset %v but got: %s, %v", batch[i % 10], i, data, err)
+                }
+        }
+
+        it := cl.NewIterator(3)
+        count := 0
+        for it.Next() {
+                if it.Record().Offset != count + 3 {
+                        t.Errorf("Expect offset %v but got: %v", count + 3, it.Record().Offset)
+                }
+                count++
+        }
+        it.Close()
+        if count != 12 || it.Err() != nil {
+                t.Errorf("Expect to iterate over 12 records but got: %v, %v", count, it.Err())
+        }
+
+        // reopening walks the compressed batches without recovery
+        cl.Close()
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        if len(cl.Recoveries()) != 0 || cl.Offset() != 14 {
+                t.Errorf("Expect to reopen at offset 14 without recovery but got: %v, %v", cl.Offset(), cl.Recoveries())
+        }
+}
+
+func TestTruncateCompressedBatch(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Codec: ZlibCodec})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendBatch([][]byte{[]byte(`a`), []byte(`b`), []byte(`c`), []byte(`d`)})
+
+        if err := cl.Truncate(2); err != nil {
+                t.Error(err)
+        }
+
+        if offset, _ := cl.Append([]byte(`e`)); offset != 2 {
+                t.Errorf("Expect next offset: 2 but got: %v", offset)
+        }
+
+        expect := []string{`a`, `b`, `e`}
+        for offset, value := range expect {
+                if data, err := cl.Read(offset); err != nil || string(data) != value {
+                        t.Errorf("Expect %v at offset %v, but got: %s, %v", value, offset, data, err)
+                }
+        }
+}
+
+func TestCompactKeysKeepsCodec(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 100, CompactionInterval: time.Hour, RetentionPolicy: -1, KeyCompaction: true, Codec: FlateCodec})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.appendRecords([]*Record{
+                {Key: []byte(`k1`), Value: []byte(`a`)},
+                {Key: []byte(`k2`), Value: []byte(`b`)},
+                {Key: []byte(`k1`), Value: []byte(`c`)},
+        })
+        cl.appendRecords([]*Record{
+                {Key: []byte(`k2`), Value: []byte(`d`)},
+        })
+
+        cl.Compact()
+
+        for _, offset := range []int{0, 1} {
+                if _, err := cl.Read(offset); err != ErrorRecordCompacted {
+                        t.Errorf("Expect ErrorRecordCompacted for offset %v, but got: %v", offset, err)
+                }
+        }
+
+        rec, err := cl.ReadRecord(2)
+        if err != nil || string(rec.Value) != `c` {
+                t.Errorf("Expect c at offset 2 but got: %+v, %v", rec, err)
+        }
+        if rec.codec != CodecFlate {
+                t.Errorf("Expect the compacted batch to stay compressed with flate but got codec: %v", rec.codec)
+        }
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) ID() byte {
+        return 100
+}
+
+func (reverseCodec) Name() string {
+        return "reverse"
+}
+
+func (reverseCodec) Compress(data []byte) ([]byte, error) {
+        out := make([]byte, len(data))
+        for i := range data {
+                out[len(data) - 1 - i] = data[i]
+        }
+        return out, nil
+}
+
+func (c reverseCodec) Decompress(data []byte) ([]byte, error) {
+        return c.Compress(data)
+}
+
+// reservedCodec is reverseCodec with an id of the built-in range.
+type reservedCodec struct {
+        reverseCodec
+        id byte
+}
+
+func (c reservedCodec) ID() byte {
+        return c.id
+}
+
+func TestRegisterCodec(t *testing.T) {
+        if _, err := New("test.db", &Options{Codec: reverseCodec{}}); err != ErrorUnknownCodec {
+                t.Errorf("Expect ErrorUnknownCodec but got: %v", err)
+        }
+
+        if err := RegisterCodec(reverseCodec{}); err != nil {
+                t.Error(err)
+        }
+        // the registry outlives the test, also across runs of -count
+        defer func() {
+                codecsMu.Lock()
+                delete(codecs, reverseCodec{}.ID())
+                codecsMu.Unlock()
+        }()
+        if err := RegisterCodec(reverseCodec{}); err != ErrorCodecRegistered {
+                t.Errorf("Expect ErrorCodecRegistered but got: %v", err)
+        }
+        for _, codec := range []Codec{reservedCodec{id: CodecNone}, reservedCodec{id: CodecGzip}, reservedCodec{id: 5}, reservedCodec{id: 15}} {
+                if err := RegisterCodec(codec); err != ErrorCodecReserved {
+                        t.Errorf("Expect ErrorCodecReserved for id %v but got: %v", codec.ID(), err)
+                }
+        }
+
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Codec: reverseCodec{}})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`abc`))
+        if data, err := cl.Read(0); err != nil || string(data) != `abc` {
+                t.Errorf("Expect abc but got: %s, %v", data, err)
+        }
+}
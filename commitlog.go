@@ -1,9 +1,12 @@
 package commitlog
 
 import (
+        "container/list"
         "errors"
         "io/ioutil"
         "os"
+        "path/filepath"
+        "sort"
         "strconv"
         "strings"
         "sync"
@@ -12,13 +15,23 @@ import (
 
 var (
         ErrorRecordNotFound = errors.New("Record Not Found")
+        ErrorRecordCompacted = errors.New("Record Compacted")
         ErrorSegmentNotFound = errors.New("Segment Not Found")
+        ErrorEmptyBatch = errors.New("Batch is empty")
+        ErrorClosed = errors.New("Commit log is closed")
 )
 
 const (
         DefaultMaxSegmentSize           = 20 * 1024 * 1024
         DefaultCompactionInterval       = 12 * time.Hour
         DefaultRetentionPolicy          = 7 * 24 * time.Hour
+        DefaultMaxRecordSize            = 1024 * 1024
+        DefaultDeleteRetention          = 24 * time.Hour
+        DefaultIndexIntervalBytes       = 4096
+        DefaultMaxOpenSegments          = 256
+        DefaultSyncEveryN               = 1000
+        DefaultSyncInterval             = time.Second
+        DefaultAckTimeout               = 10 * time.Second
 )
 
 type CommitLog struct {
@@ -26,14 +39,38 @@ type CommitLog struct {
         options         *Options
         segments        []*segment
         curSegment      *segment
+        lru             *list.List // segments with open files, the most recently used first
+        unsynced        int        // records appended since the last fsync
         mu              sync.Mutex
+        compacting      sync.Mutex // held by Compact, key compaction takes mu only to swap files
         workerDone      chan bool
+        appended        chan struct{} // closed and replaced on every append to wake up subscribers
+        closed          chan struct{}
+        pending         chan *AppendFuture // appends waiting for the group commit loop
+        offsets         *offsetStore // consumer group offsets, opened on first use
+        offsetsMu       sync.Mutex
+        replicas        *replicas // followers of this log when it is a leader
+        counters        *counters // see Stats
 }
 
 type Options struct {
         MaxSegmentSize          int
         CompactionInterval      time.Duration
-        RetentionPolicy         time.Duration
+        RetentionPolicy         time.Duration // negative to keep records forever
+        MaxRecordSize           int // encoded size of a record, key and headers included
+        KeyCompaction           bool // keep only the latest record of every key in sealed segments
+        DeleteRetention         time.Duration // how long tombstones, records with a key and a nil value, survive key compaction
+        RetentionBytes          int // cap on the total size of the log files, zero for none
+        RetentionRecords        int // cap on the number of offsets in the log, zero for none
+        IndexIntervalBytes      int // bytes of the log file between two index entries
+        MaxOpenSegments         int // segments whose files are kept open at most, each one takes three file descriptors
+        SyncPolicy              SyncPolicy // when appended records are fsynced, SyncNever by default
+        SyncEveryN              int // records between two fsyncs with SyncEveryN
+        SyncInterval            time.Duration // time between two fsyncs with SyncInterval
+        Codec                   Codec // compresses appended batches, nil for none; it has to be registered
+        Encryption              *Encryption // encrypts the values of new segments, nil for none
+        ReplicationAcks         int // followers Append waits for, zero to return once the leader has the records
+        AckTimeout              time.Duration // how long Append waits for followers
 }
 
 func NewDefaultOptions() *Options {
@@ -41,18 +78,67 @@ func NewDefaultOptions() *Options {
                 MaxSegmentSize:         DefaultMaxSegmentSize,
                 CompactionInterval:     DefaultCompactionInterval,
                 RetentionPolicy:        DefaultRetentionPolicy,
+                MaxRecordSize:          DefaultMaxRecordSize,
+                DeleteRetention:        DefaultDeleteRetention,
+                IndexIntervalBytes:     DefaultIndexIntervalBytes,
+                MaxOpenSegments:        DefaultMaxOpenSegments,
+                SyncEveryN:             DefaultSyncEveryN,
+                SyncInterval:           DefaultSyncInterval,
+                AckTimeout:             DefaultAckTimeout,
         }
 }
 
+// withDefaults returns a copy of the options where unset fields are given their default value.
+func (o *Options) withDefaults() *Options {
+        options := *o
+
+        if options.MaxRecordSize == 0 {
+                options.MaxRecordSize = DefaultMaxRecordSize
+        }
+        if options.DeleteRetention == 0 {
+                options.DeleteRetention = DefaultDeleteRetention
+        }
+        if options.IndexIntervalBytes == 0 {
+                options.IndexIntervalBytes = DefaultIndexIntervalBytes
+        }
+        if options.MaxOpenSegments == 0 {
+                options.MaxOpenSegments = DefaultMaxOpenSegments
+        }
+        if options.SyncEveryN <= 0 {
+                options.SyncEveryN = DefaultSyncEveryN
+        }
+        if options.SyncInterval <= 0 {
+                options.SyncInterval = DefaultSyncInterval
+        }
+        if options.AckTimeout <= 0 {
+                options.AckTimeout = DefaultAckTimeout
+        }
+
+        return &options
+}
+
 func New(path string, options *Options) (*CommitLog, error) {
         if options == nil {
                 options = NewDefaultOptions()
         }
+        options = options.withDefaults()
+
+        if options.Codec != nil {
+                if _, err := codecByID(options.Codec.ID()); err != nil {
+                        return nil, err
+                }
+        }
 
         cl := &CommitLog{
                 Path:           path,
                 options:        options,
+                lru:            list.New(),
                 workerDone:     make(chan bool),
+                appended:       make(chan struct{}),
+                closed:         make(chan struct{}),
+                pending:        make(chan *AppendFuture),
+                replicas:       newReplicas(),
+                counters:       &counters{},
         }
 
         if err := cl.init(); err != nil {
@@ -67,6 +153,8 @@ func New(path string, options *Options) (*CommitLog, error) {
                 return nil, err
         }
 
+        go cl.groupCommit()
+
         return cl, nil
 }
 
@@ -87,6 +175,13 @@ func (cl *CommitLog) open() error {
 
         for _, file := range files {
                 fileName := file.Name()
+                if strings.HasSuffix(fileName, compactingExt) {
+                        // left behind by a key compaction which did not finish
+                        if err := os.Remove(filepath.Join(cl.Path, fileName)); err != nil {
+                                return err
+                        }
+                        continue
+                }
                 if !strings.HasSuffix(fileName, SegExt) {
                         continue
                 }
@@ -96,21 +191,25 @@ func (cl *CommitLog) open() error {
                         return err
                 }
 
-                seg, err := NewSegment(cl.Path, offset, cl.options)
-                if err != nil {
-                        return err
-                }
-
+                // the files of sealed segments are opened on first use, see acquire
+                seg := newSegment(cl.Path, offset, cl.options)
                 cl.segments = append(cl.segments, seg)
                 cl.curSegment = seg
         }
 
-        if len(files) == 0 {
+        for _, seg := range cl.segments {
+                seg.isSealed = seg != cl.curSegment
+        }
+
+        if len(cl.segments) == 0 {
                 if err := cl.createNewSegment(0); err != nil {
                         return err
                 }
         }
 
+        if err := cl.acquire(cl.curSegment); err != nil {
+                return err
+        }
         if err := cl.curSegment.Load(); err != nil {
                 return err
         }
@@ -122,12 +221,23 @@ func (cl *CommitLog) startWorker() error {
         go func() {
                 ticker := time.NewTicker(cl.options.CompactionInterval)
 
+                // the background flusher only runs with the SyncInterval policy
+                var syncC <-chan time.Time
+                if cl.options.SyncPolicy == SyncInterval {
+                        syncTicker := time.NewTicker(cl.options.SyncInterval)
+                        defer syncTicker.Stop()
+                        syncC = syncTicker.C
+                }
+
                 for {
                         select {
                         case <- cl.workerDone:
-                                break
+                                ticker.Stop()
+                                return
                         case <- ticker.C:
-                                cl.Compact()
+                                cl.Compact() // failures are counted in Stats.CompactionErrors
+                        case <- syncC:
+                                cl.syncUnsynced()
                         }
                 }
         }()
@@ -146,12 +256,18 @@ func (cl *CommitLog) createNewSegment(offset int) error {
         }
 
         if cl.curSegment != nil {
-                cl.curSegment.clearCache()
+                if err := cl.curSegment.seal(); err != nil {
+                        return err
+                }
         }
 
         cl.segments = append(cl.segments, seg)
         cl.curSegment = seg
 
+        if err := cl.acquire(seg); err != nil {
+                return err
+        }
+
         if err := cl.curSegment.Load(); err != nil {
                 return err
         }
@@ -159,38 +275,274 @@ func (cl *CommitLog) createNewSegment(offset int) error {
         return nil
 }
 
+// Append appends a record with data as its value and returns its offset.
+// The record is readable as soon as Append returns, whether it is on disk yet depends on Options.SyncPolicy:
+// with SyncEveryAppend it is, with SyncEveryN and SyncInterval at most that many records or that much time
+// of appends may be lost when the machine crashes, with SyncNever it is up to the OS.
 func (cl *CommitLog) Append(data []byte) (int, error) {
+        return cl.AppendRecord(&Record{Value: data})
+}
+
+// AppendRecord appends a record with its key and headers, Offset is ignored
+// and a zero Timestamp is set to the time of writing.
+func (cl *CommitLog) AppendRecord(rec *Record) (int, error) {
+        offset, _, err := cl.appendRecords([]*Record{rec})
+
+        return offset, err
+}
+
+// AppendBatch appends all records with a single write and returns the offsets of the first and the last one.
+// A batch never spans two segments and after a crash either all of its records are kept or none.
+func (cl *CommitLog) AppendBatch(data [][]byte) (int, int, error) {
+        recs := make([]*Record, len(data))
+        for i := range data {
+                recs[i] = &Record{Value: data[i]}
+        }
+
+        return cl.appendRecords(recs)
+}
+
+// AppendRecords appends records with their keys and headers as a batch, like AppendBatch.
+func (cl *CommitLog) AppendRecords(recs []*Record) (int, int, error) {
+        return cl.appendRecords(recs)
+}
+
+func (cl *CommitLog) appendRecords(recs []*Record) (int, int, error) {
+        if len(recs) == 0 {
+                return 0, 0, ErrorEmptyBatch
+        }
+
+        for _, rec := range recs {
+                if err := cl.checkRecord(rec); err != nil {
+                        return 0, 0, err
+                }
+        }
+
+        first, last, err := cl.appendLocked(recs)
+        if err != nil {
+                return 0, 0, err
+        }
+
+        // the records stay appended when followers do not catch up in time
+        if err := cl.waitAcks(last); err != nil {
+                return first, last, err
+        }
+
+        return first, last, nil
+}
+
+func (cl *CommitLog) appendLocked(recs []*Record) (int, int, error) {
         cl.mu.Lock()
         defer cl.mu.Unlock()
 
+        first, last, err := cl.writeRecords(recs)
+        if err != nil {
+                return 0, 0, err
+        }
+
+        if err := cl.syncAppended(len(recs)); err != nil {
+                return 0, 0, err
+        }
+
+        return first, last, nil
+}
+
+func (cl *CommitLog) checkRecord(rec *Record) error {
+        if size := recordV3Size(rec); size > cl.options.MaxRecordSize || size > maxRecordSize {
+                return ErrorExceedMaxRecordSize
+        }
+
+        return nil
+}
+
+// writeRecords writes recs to the active segment as one batch at the next offsets, callers hold cl.mu.
+func (cl *CommitLog) writeRecords(recs []*Record) (int, int, error) {
         offset := cl.curSegment.NextOffset()
 
-        if cl.curSegment.CheckFull(data) {
-                cl.createNewSegment(offset)
+        batch := make([]*Record, len(recs))
+        for i, rec := range recs {
+                copied := *rec
+                copied.Offset = offset + i
+                batch[i] = &copied
         }
 
-        if err := cl.curSegment.Write(data); err != nil {
-                return 0, err
+        if err := cl.writeAt(batch); err != nil {
+                return 0, 0, err
+        }
+
+        return offset, offset + len(recs) - 1, nil
+}
+
+// writeAt writes recs, which carry their offsets, as one batch and wakes up subscribers. Offsets must be
+// increasing from the next offset on, gaps are left by records compacted away on a leader. Callers hold cl.mu.
+func (cl *CommitLog) writeAt(recs []*Record) error {
+        // segments in an older format or not encrypted as configured are never written to, the log rolls over instead
+        encrypted := cl.options.Encryption != nil
+        if cl.curSegment.CheckFull(recs) || cl.curSegment.version != currentFormat || cl.curSegment.encrypted() != encrypted {
+                if err := cl.createNewSegment(recs[0].Offset); err != nil {
+                        return err
+                }
+        }
+
+        position := cl.curSegment.position
+        if err := cl.curSegment.Write(recs); err != nil {
+                return err
         }
+        cl.counters.appended(len(recs), cl.curSegment.position - position)
+
+        close(cl.appended)
+        cl.appended = make(chan struct{})
 
-        return offset, nil
+        return nil
 }
 
 func (cl *CommitLog) Read(offset int) ([]byte, error) {
+        rec, err := cl.ReadRecord(offset)
+        if err != nil {
+                return nil, err
+        }
+
+        return rec.Value, nil
+}
+
+func (cl *CommitLog) ReadRecord(offset int) (*Record, error) {
+        start := time.Now()
+        defer func() {
+                cl.counters.read(time.Since(start))
+        }()
+
+        return cl.readRecord(offset)
+}
+
+func (cl *CommitLog) readRecord(offset int) (*Record, error) {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
         i, err := cl.findSegmentIndex(offset)
         if err != nil {
                 return nil, err
         }
 
-        return cl.segments[i].Read(offset)
+        if err := cl.acquire(cl.segments[i]); err != nil {
+                return nil, err
+        }
+
+        rec, err := cl.segments[i].Read(offset)
+        // sealed segments only miss offsets which key compaction removed
+        if err == ErrorRecordNotFound && i < len(cl.segments) - 1 {
+                return nil, ErrorRecordCompacted
+        }
+
+        return rec, err
+}
+
+// OffsetForTime returns the first offset written at or after tm, across all segments.
+func (cl *CommitLog) OffsetForTime(tm time.Time) (int, error) {
+        offset, err := cl.indexedOffsetForTime(tm)
+        if err != nil {
+                return 0, err
+        }
+
+        // the time index keeps seconds, skip the records written within the second of tm but before it
+        it := cl.NewIterator(offset)
+        defer it.Close()
+        for it.Next() {
+                if !it.Record().Timestamp.Before(tm) {
+                        return it.Record().Offset, nil
+                }
+        }
+        if err := it.Err(); err != nil {
+                return 0, err
+        }
+
+        return 0, ErrorRecordNotFound
+}
+
+// indexedOffsetForTime returns the first offset of the time index written in the second of tm or later.
+func (cl *CommitLog) indexedOffsetForTime(tm time.Time) (int, error) {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        timestamp := uint32(tm.Unix())
+
+        // the first segment whose last record was written at or after tm, segments are opened to read their time index
+        var err error
+        i := sort.Search(len(cl.segments), func(i int) bool {
+                if err == nil {
+                        err = cl.acquire(cl.segments[i])
+                }
+                return err != nil || cl.segments[i].timeindex.lastCreatedAt >= timestamp
+        })
+        if err != nil {
+                return 0, err
+        }
+        if i == len(cl.segments) {
+                return 0, ErrorRecordNotFound
+        }
+
+        if err := cl.acquire(cl.segments[i]); err != nil {
+                return 0, err
+        }
+
+        offset, ok, err := cl.segments[i].timeindex.firstOffsetFromTm(tm)
+        if err != nil {
+                return 0, err
+        }
+        if !ok {
+                return 0, ErrorRecordNotFound
+        }
+
+        return cl.segments[i].baseOffset + offset, nil
+}
+
+// Truncate discards every record at or after offset, so that the next Append continues from offset.
+func (cl *CommitLog) Truncate(offset int) error {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        if offset < 0 || offset > cl.curSegment.NextOffset() {
+                return ErrorRecordNotFound
+        }
+
+        i, err := cl.findSegmentIndex(offset)
+        if err != nil {
+                return err
+        }
+
+        // drop later segments from the newest one, a crash in between still leaves a prefix of the log
+        for j := len(cl.segments) - 1; j > i; j-- {
+                if err := cl.removeSegment(cl.segments[j]); err != nil {
+                        return err
+                }
+                cl.segments = cl.segments[:j]
+        }
+        cl.curSegment = cl.segments[i]
+        if err := cl.acquire(cl.curSegment); err != nil {
+                return err
+        }
+        if err := cl.curSegment.unseal(); err != nil {
+                return err
+        }
+        if err := cl.curSegment.truncateTo(offset); err != nil {
+                return err
+        }
+
+        // key compaction may have removed the records right before offset, a new segment
+        // named after offset keeps the next offset, also across a restart
+        if cl.curSegment.NextOffset() < offset {
+                return cl.createNewSegment(offset)
+        }
+
+        return nil
 }
 
 func (cl *CommitLog) findSegmentIndex(offset int) (int, error) {
+        if offset < cl.segments[0].baseOffset {
+                return -1, ErrorSegmentNotFound
+        }
+
         for i := 0; i < len(cl.segments)-1; i++ {
-                if offset < cl.segments[i].baseOffset {
-                        return -1, ErrorSegmentNotFound
-                }
-                if offset >= cl.segments[i].baseOffset && offset < cl.segments[i+1].baseOffset {
+                if offset < cl.segments[i+1].baseOffset {
                         return i, nil
                 }
         }
@@ -198,12 +550,40 @@ func (cl *CommitLog) findSegmentIndex(offset int) (int, error) {
         return len(cl.segments) - 1, nil
 }
 
+// MaxRecordSize returns the encoded size a record may have in the log, see Options.MaxRecordSize.
+func (cl *CommitLog) MaxRecordSize() int {
+        return cl.options.MaxRecordSize
+}
+
 func (cl *CommitLog) Offset() int {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
         return cl.curSegment.NextOffset() - 1
 }
 
+// Recoveries reports the segments which were repaired while opening the log after an unclean shutdown.
+func (cl *CommitLog) Recoveries() []*RecoveryReport {
+        reports := make([]*RecoveryReport, 0)
+
+        for _, seg := range cl.segments {
+                if seg.recovery != nil {
+                        reports = append(reports, seg.recovery)
+                }
+        }
+
+        return reports
+}
+
 func (cl *CommitLog) Close() error {
-        if err := cl.curSegment.Sync(); err != nil {
+        if err := cl.closeOffsetStore(); err != nil {
+                return err
+        }
+
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        if err := cl.sync(); err != nil {
                 return err
         }
 
@@ -214,6 +594,7 @@ func (cl *CommitLog) Close() error {
         }
 
         cl.stopWorker()
+        close(cl.closed)
 
         return nil
 }
@@ -2,8 +2,12 @@ package commitlog
 
 import (
         "bytes"
+        "encoding/binary"
+        "errors"
+        "hash/crc32"
         "io/ioutil"
         "os"
+        "path/filepath"
         "testing"
         "time"
 )
@@ -36,14 +40,14 @@ func TestNew(t *testing.T) {
 }
 
 func TestNewSegment(t *testing.T) {
-        cl, err := New("test.db", &Options{30, time.Hour, time.Hour}) //30 bytes max segment size
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //80 bytes max segment size, 8 bytes of segment header
         if err != nil {
                 t.Error(err)
         }
 
-        cl.Append([]byte(`0123456789`)) //(4 + 10) bytes
-        cl.Append([]byte(`0123456789`)) //(4 + 10) bytes
-        cl.Append([]byte(`0123456789`)) //(4 + 10) bytes, open another new segment
+        cl.Append([]byte(`0123456789`)) //(24 + 10) bytes
+        cl.Append([]byte(`0123456789`)) //(24 + 10) bytes
+        cl.Append([]byte(`0123456789`)) //(24 + 10) bytes, open another new segment
 
         total := cl.Offset()
 
@@ -120,6 +124,704 @@ func TestReadRecordNotExist(t *testing.T) {
         cleanup(cl)
 }
 
+func TestRecoverTornRecord(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.Append([]byte(`123`))
+        cl.Append([]byte(`456`))
+        cl.Append([]byte(`789`))
+        cl.Close()
+
+        // lose the buffered index entries and tear the last record apart
+        os.Truncate("test.db/00000000000000000000.index", 0)
+        f, _ := os.OpenFile("test.db/00000000000000000000.log", os.O_WRONLY|os.O_APPEND, 0666)
+        f.Write([]byte{10, 0, 'a', 'b'})
+        f.Close()
+
+        cl, err = New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if offset := cl.Offset(); offset != 2 {
+                t.Errorf("Expect offset: 2 after recovery, but got: %v", offset)
+        }
+
+        data, err := cl.Read(2)
+        if err != nil || !bytes.Equal([]byte(`789`), data) {
+                t.Errorf("Expect got back last record: %v, but got: %v, %v", []byte(`789`), data, err)
+        }
+
+        reports := cl.Recoveries()
+        if len(reports) != 1 {
+                t.Fatalf("Expect 1 recovery report, but got: %v", len(reports))
+        }
+        // the sparse index only holds the first record of the segment
+        if reports[0].TruncatedBytes != 4 || reports[0].IndexEntries != 1 || reports[0].Records != 3 {
+                t.Errorf("Expect 4 truncated bytes and 1 rebuilt index entry, but got: %+v", reports[0])
+        }
+
+        offset, _ := cl.Append([]byte(`abc`))
+        if offset != 3 {
+                t.Errorf("Expect next offset: 3, but got: %v", offset)
+        }
+}
+
+func TestReopenWithoutRecovery(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.Append([]byte(`123`))
+        cl.Append([]byte(`456`))
+        cl.Close()
+
+        cl, err = New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if reports := cl.Recoveries(); len(reports) != 0 {
+                t.Errorf("Expect no recovery after a clean close, but got: %+v", reports[0])
+        }
+}
+
+func TestTruncate(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 5; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+
+        if err := cl.Truncate(3); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+
+        if offset := cl.Offset(); offset != 2 {
+                t.Errorf("Expect offset: 2 after truncation, but got: %v", offset)
+        }
+
+        files, _ := ioutil.ReadDir("test.db")
+        if len(files) != 6 {
+                t.Errorf("Expect segments 0 and 2 to be left, but got %v files", len(files))
+        }
+
+        offset, _ := cl.Append([]byte(`abc`))
+        if offset != 3 {
+                t.Errorf("Expect next offset: 3, but got: %v", offset)
+        }
+
+        data, err := cl.Read(3)
+        if err != nil || !bytes.Equal([]byte(`abc`), data) {
+                t.Errorf("Expect got back appended record: %v, but got: %v, %v", []byte(`abc`), data, err)
+        }
+}
+
+func TestTruncateBeyondEnd(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`123`))
+
+        if err := cl.Truncate(5); err != ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+}
+
+func TestTruncateNegative(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`123`))
+
+        if err := cl.Truncate(-3); err != ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+        if offset, _ := cl.Append([]byte(`456`)); offset != 1 {
+                t.Errorf("Expect next offset: 1, but got: %v", offset)
+        }
+}
+
+func TestTruncateBeforeFirstSegment(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: -1, RetentionRecords: 1})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 5; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Compact()
+
+        if len(cl.segments) != 1 || cl.segments[0].baseOffset != 4 {
+                t.Fatalf("Expect only segment 4 to be left, but got %v segments", len(cl.segments))
+        }
+        if err := cl.Truncate(1); err != ErrorSegmentNotFound {
+                t.Errorf("Expect ErrorSegmentNotFound but got: %v", err)
+        }
+        if offset := cl.Offset(); offset != 4 {
+                t.Errorf("Expect offset: 4, but got: %v", offset)
+        }
+        if _, err := cl.Read(1); err != ErrorSegmentNotFound {
+                t.Errorf("Expect ErrorSegmentNotFound but got: %v", err)
+        }
+}
+
+func TestReadCorruptRecord(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`123`))
+        cl.Append([]byte(`456`))
+
+        // flip the first byte of the second value: 8 bytes segment header + (24 + 3) bytes + 24 bytes record header
+        f, _ := os.OpenFile("test.db/00000000000000000000.log", os.O_WRONLY, 0666)
+        f.WriteAt([]byte(`X`), 8 + 27 + 24)
+        f.Close()
+
+        _, err = cl.Read(1)
+        if !errors.Is(err, ErrorCorruptRecord) {
+                t.Fatalf("Expect ErrorCorruptRecord but got: %v", err)
+        }
+        if corrupt := err.(*CorruptRecordError); corrupt.Offset != 1 {
+                t.Errorf("Expect corrupted offset: 1, but got: %v", corrupt.Offset)
+        }
+
+        if _, err := cl.Read(0); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+}
+
+func TestRecoverCorruptTail(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.Append([]byte(`123`))
+        cl.Append([]byte(`456`))
+        cl.Append([]byte(`789`))
+        cl.Close()
+
+        os.Truncate("test.db/00000000000000000000.index", 0)
+        f, _ := os.OpenFile("test.db/00000000000000000000.log", os.O_WRONLY, 0666)
+        f.WriteAt([]byte(`X`), 8 + 27 + 27 + 24)
+        f.Close()
+
+        cl, err = New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if offset := cl.Offset(); offset != 1 {
+                t.Errorf("Expect the corrupted last record to be dropped, but got offset: %v", offset)
+        }
+}
+
+func TestOpenLegacySegment(t *testing.T) {
+        setupDir("test.db")
+        ioutil.WriteFile("test.db/00000000000000000000.log", []byte{3, 0, '1', '2', '3', 3, 0, '4', '5', '6'}, 0666)
+
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        data, err := cl.Read(1)
+        if err != nil || !bytes.Equal([]byte(`456`), data) {
+                t.Errorf("Expect got back legacy record: %v, but got: %v, %v", []byte(`456`), data, err)
+        }
+
+        offset, _ := cl.Append([]byte(`789`))
+        if offset != 2 {
+                t.Errorf("Expect next offset: 2, but got: %v", offset)
+        }
+        if cl.curSegment.baseOffset != 2 || cl.curSegment.version != currentFormat {
+                t.Errorf("Expect appends to roll over to a new segment in the current format")
+        }
+
+        data, err = cl.Read(2)
+        if err != nil || !bytes.Equal([]byte(`789`), data) {
+                t.Errorf("Expect got back appended record: %v, but got: %v, %v", []byte(`789`), data, err)
+        }
+}
+
+func TestOpenV2Segment(t *testing.T) {
+        setupDir("test.db")
+        data := []byte{'C', 'L', 'O', 'G', 2, 0, 0, 0, 3, 0, 0, 0, 0, 0, '1', '2', '3'}
+        binary.LittleEndian.PutUint32(data[10:14], crc32.Checksum([]byte(`123`), crc32.MakeTable(crc32.Castagnoli)))
+        ioutil.WriteFile("test.db/00000000000000000000.log", data, 0666)
+
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        rec, err := cl.ReadRecord(0)
+        if err != nil || string(rec.Value) != `123` || rec.Key != nil {
+                t.Errorf("Expect got back v2 record: %v, but got: %+v, %v", []byte(`123`), rec, err)
+        }
+
+        offset, _ := cl.AppendRecord(&Record{Key: []byte(`k`), Value: []byte(`456`)})
+        if rec, err := cl.ReadRecord(offset); err != nil || string(rec.Key) != `k` {
+                t.Errorf("Expect got back appended record with key, but got: %+v, %v", rec, err)
+        }
+}
+
+func TestAppendLargeRecord(t *testing.T) {
+        cl, err := New("test.db", &Options{
+                MaxSegmentSize:         1024 * 1024,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        time.Hour,
+                MaxRecordSize:          4 * 1024 * 1024,
+        })
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        data := bytes.Repeat([]byte(`a`), 2 * 1024 * 1024)
+        data[len(data)-1] = 'z'
+
+        cl.Append([]byte(`123`))
+        offset, err := cl.Append(data)
+        if err != nil || offset != 1 {
+                t.Errorf("Expect offset: 1 and nil error, but got: %v, %v", offset, err)
+        }
+        if got, err := cl.Read(1); err != nil || !bytes.Equal(data, got) {
+                t.Errorf("Expect got back the 2 MiB record, but got %v bytes, %v", len(got), err)
+        }
+
+        offset, _ = cl.Append([]byte(`456`))
+        if offset != 2 || cl.curSegment.baseOffset != 2 {
+                t.Errorf("Expect a record bigger than a segment to get a segment of its own")
+        }
+
+        if _, err := cl.Append(make([]byte, 5 * 1024 * 1024)); err != ErrorExceedMaxRecordSize {
+                t.Errorf("Expect ErrorExceedMaxRecordSize but got: %v", err)
+        }
+}
+
+func TestCheckFullCloseToMaxSegmentSize(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 76, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`)) //8 + 34 bytes
+        cl.Append([]byte(`0123456789`)) //fills the segment up to exactly 76 bytes
+        cl.Append([]byte(``))
+
+        if cl.curSegment.baseOffset != 2 {
+                t.Errorf("Expect the third record to open a new segment at 2, but got: %v", cl.curSegment.baseOffset)
+        }
+        if fi, _ := os.Stat("test.db/00000000000000000000.log"); fi.Size() != 76 {
+                t.Errorf("Expect first segment of 76 bytes, but got: %v", fi.Size())
+        }
+}
+
+func TestAppendBatch(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 100, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`)) //8 + 34 bytes
+
+        first, last, err := cl.AppendBatch([][]byte{[]byte(`0123456789`), []byte(`0123456789`), []byte(`0123456789`)})
+        if err != nil || first != 1 || last != 3 {
+                t.Errorf("Expect offsets 1 to 3 and nil error, but got: %v, %v, %v", first, last, err)
+        }
+
+        // 42 + 102 bytes exceed 100, the whole batch goes to a new segment which it overfills
+        if cl.curSegment.baseOffset != 1 || cl.curSegment.count != 3 {
+                t.Errorf("Expect the batch not to be split over segments, but got segment %v with %v records", cl.curSegment.baseOffset, cl.curSegment.count)
+        }
+
+        if data, err := cl.Read(3); err != nil || !bytes.Equal([]byte(`0123456789`), data) {
+                t.Errorf("Expect got back last record of the batch, but got: %v, %v", data, err)
+        }
+
+        if _, _, err := cl.AppendBatch(nil); err != ErrorEmptyBatch {
+                t.Errorf("Expect ErrorEmptyBatch but got: %v", err)
+        }
+}
+
+func TestRecoverPartialBatch(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.Append([]byte(`123`))
+        cl.AppendBatch([][]byte{[]byte(`456`), []byte(`789`), []byte(`abc`)})
+        cl.Close()
+
+        // the first two records of the batch are left with their index entries, so the files agree otherwise
+        os.Truncate("test.db/00000000000000000000.log", 8 + 3 * 27)
+        os.Truncate("test.db/00000000000000000000.timeindex", 3 * timeIndexRecordSize)
+
+        cl, err = New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if offset := cl.Offset(); offset != 0 {
+                t.Errorf("Expect the partial batch to be dropped, but got offset: %v", offset)
+        }
+        if _, err := cl.Read(1); err != ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+        if reports := cl.Recoveries(); len(reports) != 1 || reports[0].TruncatedBytes != 2 * 27 {
+                t.Errorf("Expect 54 truncated bytes, but got: %+v", reports)
+        }
+}
+
+func TestRecoverTornBatch(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.Append([]byte(`123`))
+        cl.AppendBatch([][]byte{[]byte(`456`), []byte(`789`), []byte(`abc`)})
+        cl.Close()
+
+        // keep the first two records of the batch only: 8 bytes segment header + 3 * 27 bytes
+        os.Truncate("test.db/00000000000000000000.index", 0)
+        os.Truncate("test.db/00000000000000000000.log", 8 + 3 * 27)
+
+        cl, err = New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if offset := cl.Offset(); offset != 0 {
+                t.Errorf("Expect the torn batch to be dropped as a whole, but got offset: %v", offset)
+        }
+        if reports := cl.Recoveries(); len(reports) != 1 || reports[0].TruncatedBytes != 2 * 27 {
+                t.Errorf("Expect 54 truncated bytes, but got: %+v", reports)
+        }
+
+        first, _, _ := cl.AppendBatch([][]byte{[]byte(`456`)})
+        if first != 1 {
+                t.Errorf("Expect next offset: 1, but got: %v", first)
+        }
+}
+
+func TestAppendRecord(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        tm := time.Date(2020, 5, 1, 9, 0, 0, int(123 * time.Millisecond), time.UTC)
+        cl.Append([]byte(`123`))
+        offset, err := cl.AppendRecord(&Record{
+                Timestamp:      tm,
+                Key:            []byte(`user-1`),
+                Headers:        []Header{{"content-type", "text/plain"}, {"trace", ""}},
+                Value:          []byte(`456`),
+        })
+        if err != nil || offset != 1 {
+                t.Errorf("Expect offset: 1 and nil error, but got: %v, %v", offset, err)
+        }
+
+        rec, err := cl.ReadRecord(1)
+        if err != nil {
+                t.Fatalf("Expect nil error but got: %v", err)
+        }
+        if rec.Offset != 1 || !rec.Timestamp.Equal(tm) || string(rec.Key) != `user-1` || string(rec.Value) != `456` {
+                t.Errorf("Expect got back the appended record, but got: %+v", rec)
+        }
+        if len(rec.Headers) != 2 || rec.Headers[0] != (Header{"content-type", "text/plain"}) || rec.Headers[1] != (Header{"trace", ""}) {
+                t.Errorf("Expect got back 2 headers, but got: %+v", rec.Headers)
+        }
+
+        rec, _ = cl.ReadRecord(0)
+        if rec.Key != nil || rec.Timestamp.IsZero() {
+                t.Errorf("Expect a nil key and the time of writing, but got: %+v", rec)
+        }
+}
+
+func TestAppendNilValue(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendRecord(&Record{Key: []byte(`user-1`)})
+        cl.Append([]byte{})
+
+        if data, _ := cl.Read(0); data != nil {
+                t.Errorf("Expect nil value but got: %v", data)
+        }
+        if data, _ := cl.Read(1); data == nil || len(data) != 0 {
+                t.Errorf("Expect empty value but got: %v", data)
+        }
+}
+
+func TestOffsetForTime(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        start := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+        for i := 0; i < 7; i++ {
+                cl.AppendRecord(&Record{Timestamp: start.Add(time.Duration(i) * time.Hour), Value: []byte(`012345678`)})
+        }
+
+        cases := []struct {
+                tm      time.Time
+                offset  int
+        }{
+                {start.Add(-1 * time.Hour), 0},
+                {start, 0},
+                {start.Add(90 * time.Minute), 2},
+                {start.Add(3 * time.Hour), 3},
+                {start.Add(6 * time.Hour), 6},
+        }
+        for _, c := range cases {
+                offset, err := cl.OffsetForTime(c.tm)
+                if err != nil || offset != c.offset {
+                        t.Errorf("Expect offset %v for %v, but got: %v, %v", c.offset, c.tm, offset, err)
+                }
+        }
+
+        if _, err := cl.OffsetForTime(start.Add(7 * time.Hour)); err != ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+}
+
+func TestOffsetForTimeWithinSecond(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        start := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+        for i := 0; i < 5; i++ {
+                cl.AppendRecord(&Record{Timestamp: start.Add(time.Duration(i) * 200 * time.Millisecond), Value: []byte(`012345678`)})
+        }
+
+        cases := []struct {
+                tm      time.Time
+                offset  int
+        }{
+                {start, 0},
+                {start.Add(300 * time.Millisecond), 2},
+                {start.Add(400 * time.Millisecond), 2},
+                {start.Add(700 * time.Millisecond), 4},
+        }
+        for _, c := range cases {
+                offset, err := cl.OffsetForTime(c.tm)
+                if err != nil || offset != c.offset {
+                        t.Errorf("Expect offset %v for %v, but got: %v, %v", c.offset, c.tm, offset, err)
+                }
+        }
+
+        if _, err := cl.OffsetForTime(start.Add(900 * time.Millisecond)); err != ErrorRecordNotFound {
+                t.Errorf("Expect ErrorRecordNotFound but got: %v", err)
+        }
+}
+
+func TestOpenSegmentsLazily(t *testing.T) {
+        options := &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour} //two records per segment
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Close()
+
+        // an index file which was never written to, it is left alone until the segment is used
+        index := filepath.Join("test.db", "00000000000000000002" + IndexExt)
+        os.Truncate(index, 0)
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if cl.lru.Len() != 1 || cl.segments[0].isOpen || cl.segments[2].isOpen || !cl.curSegment.isOpen {
+                t.Errorf("Expect only the active segment to be open but got %v open segments", cl.lru.Len())
+        }
+        if fi, _ := os.Stat(index); fi.Size() != 0 {
+                t.Errorf("Expect the index file not to be written at startup but got %v bytes", fi.Size())
+        }
+
+        if data, err := cl.Read(2); err != nil || string(data) != `0123456789` {
+                t.Errorf("Expect to read back offset 2 but got: %s, %v", data, err)
+        }
+        if !cl.segments[1].isOpen || cl.segments[1].version != currentFormat {
+                t.Errorf("Expect the segment to be opened on first use")
+        }
+        if offset, err := cl.OffsetForTime(time.Now().Add(-time.Minute)); err != nil || offset != 0 {
+                t.Errorf("Expect offset 0 but got: %v, %v", offset, err)
+        }
+}
+
+func TestSealedSegmentIndexesMapped(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 5; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Close()
+
+        cl, err = New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+
+        if data, err := cl.Read(1); err != nil || !bytes.Equal([]byte(`0123456789`), data) {
+                t.Errorf("Expect to read back offset 1 but got: %v, %v", data, err)
+        }
+
+        if seg := cl.segments[0]; !seg.isSealed || !seg.index.isMapped || !seg.timeindex.isMapped {
+                t.Errorf("Expect the indexes of the sealed segment to be mapped")
+        }
+        if seg := cl.curSegment; seg.index.isMapped || seg.timeindex.isMapped {
+                t.Errorf("Expect the indexes of the active segment not to be mapped")
+        }
+
+        if offset, err := cl.OffsetForTime(time.Now().Add(-time.Hour)); err != nil || offset != 0 {
+                t.Errorf("Expect offset 0 but got: %v, %v", offset, err)
+        }
+
+        // the truncated segment is the active one again
+        if err := cl.Truncate(1); err != nil {
+                t.Error(err)
+        }
+        if cl.curSegment.isSealed || cl.curSegment.index.isMapped {
+                t.Errorf("Expect the truncated segment to be unsealed")
+        }
+
+        if offset, err := cl.Append([]byte(`abc`)); err != nil || offset != 1 {
+                t.Errorf("Expect next offset: 1, but got: %v, %v", offset, err)
+        }
+        if data, err := cl.Read(1); err != nil || !bytes.Equal([]byte(`abc`), data) {
+                t.Errorf("Expect got back appended record but got: %v, %v", data, err)
+        }
+}
+
+func TestMaxOpenSegments(t *testing.T) {
+        options := &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, MaxOpenSegments: 2} //two records per segment
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 10; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Close()
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 10; i++ {
+                if data, err := cl.Read(i); err != nil || !bytes.Equal([]byte(`0123456789`), data) {
+                        t.Errorf("Expect to read back offset %v but got: %v, %v", i, data, err)
+                }
+        }
+
+        it := cl.NewIterator(0)
+        count := 0
+        for it.Next() {
+                count++
+        }
+        it.Close()
+        if count != 10 || it.Err() != nil {
+                t.Errorf("Expect to iterate over 10 records but got: %v, %v", count, it.Err())
+        }
+
+        open := 0
+        for _, seg := range cl.segments {
+                if seg.isOpen {
+                        open++
+                }
+        }
+        if open != 2 || !cl.curSegment.isOpen {
+                t.Errorf("Expect 2 segments with open files, the active one included, but got: %v", open)
+        }
+}
+
+func TestMaxOpenSegmentsPinned(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, MaxOpenSegments: 1}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+
+        // the iterator keeps segment 0 open, the cap is exceeded while it does
+        it := cl.NewIterator(0)
+        if !it.Next() {
+                t.Errorf("Expect to read record 0 but got: %v", it.Err())
+        }
+
+        if data, err := cl.Read(4); err != nil || string(data) != `0123456789` {
+                t.Errorf("Expect to read back offset 4 but got: %s, %v", data, err)
+        }
+        if !it.Next() || it.Record().Offset != 1 {
+                t.Errorf("Expect to read record 1 but got: %v", it.Err())
+        }
+        it.Close()
+
+        // once released, the segments over the cap are closed on the next acquire
+        cl.Read(6)
+        if cl.lru.Len() != 1 {
+                t.Errorf("Expect 1 segment with open files but got: %v", cl.lru.Len())
+        }
+}
+
 func BenchmarkWrite256B(b *testing.B) {
         benchmarkWriteSize(b, 256)
 }
@@ -147,6 +849,20 @@ func benchmarkWriteSize(b *testing.B, size int) {
         cleanup(cl)
 }
 
+func BenchmarkAppendBatch100x256B(b *testing.B) {
+        cl, _ := New("test.db", nil)
+        batch := make([][]byte, 100)
+        for i := range batch {
+                batch[i] = make([]byte, 256)
+        }
+
+        for i := 0; i < b.N; i++ {
+                cl.AppendBatch(batch)
+        }
+
+        cleanup(cl)
+}
+
 func cleanup(cl *CommitLog) {
 	os.RemoveAll(cl.Path)
 }
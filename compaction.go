@@ -1,29 +1,410 @@
 package commitlog
 
 import (
+        "bufio"
+        "os"
+        "sync/atomic"
         "time"
 )
 
-func (cl *CommitLog) Compact() {
+const (
+        compactingExt = ".compacting"
+)
+
+// Compact applies the retention options and key compaction. Every step is run and the first error is returned,
+// failed runs are counted in Stats.CompactionErrors since the background worker has no one to return them to.
+func (cl *CommitLog) Compact() error {
+        cl.compacting.Lock()
+        defer cl.compacting.Unlock()
+
+        atomic.AddUint64(&cl.counters.compactions, 1)
+
+        var errs []error
+        if cl.options.RetentionPolicy >= 0 {
+                errs = append(errs, cl.deleteExpiredSegments())
+        }
+
+        if cl.options.RetentionBytes > 0 || cl.options.RetentionRecords > 0 {
+                errs = append(errs, cl.deleteExcessSegments())
+        }
+
+        if cl.options.KeyCompaction {
+                errs = append(errs, cl.compactKeys())
+        }
+
+        for _, err := range errs {
+                if err != nil {
+                        atomic.AddUint64(&cl.counters.compactionErrors, 1)
+                        return err
+                }
+        }
+
+        return nil
+}
+
+func (cl *CommitLog) deleteExpiredSegments() error {
         tm := time.Now().Add(-1 * cl.options.RetentionPolicy)
 
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        // the active segment is never removed
         lastSegment := 0
-        for _, seg := range cl.segments {
+        for _, seg := range cl.segments[:len(cl.segments)-1] {
+                if err := cl.acquire(seg); err != nil {
+                        return err
+                }
+
                 off, err := seg.timeindex.lastOffsetBeforeTm(tm)
                 if err != nil {
+                        return err
+                }
+                if off != -2 {
+                        break
+                }
+                lastSegment++
+        }
 
+        // segments which failed to be removed are kept, and the ones after them to leave no gap
+        removed := 0
+        defer func() {
+                cl.segments = cl.segments[removed:]
+        }()
+
+        for removed < lastSegment {
+                size, err := cl.segments[removed].size()
+                if err != nil {
+                        return err
                 }
-                if off == -2 {
-                        lastSegment++
-                } else {
+                if err := cl.removeSegment(cl.segments[removed]); err != nil {
+                        return err
+                }
+                cl.counters.compacted(size)
+                removed++
+        }
+
+        return nil
+}
+
+// deleteExcessSegments removes the oldest sealed segments until the log fits
+// into RetentionBytes and RetentionRecords, the active segment is never removed.
+func (cl *CommitLog) deleteExcessSegments() error {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        size := 0
+        sizes := make([]int, len(cl.segments))
+        for i, seg := range cl.segments {
+                n, err := seg.size()
+                if err != nil {
+                        return err
+                }
+                sizes[i] = n
+                size += n
+        }
+
+        next := cl.curSegment.NextOffset()
+        removed := 0
+        defer func() {
+                cl.segments = cl.segments[removed:]
+        }()
+
+        for removed < len(cl.segments) - 1 {
+                exceedBytes := cl.options.RetentionBytes > 0 && size > cl.options.RetentionBytes
+                exceedRecords := cl.options.RetentionRecords > 0 && next - cl.segments[removed].baseOffset > cl.options.RetentionRecords
+                if !exceedBytes && !exceedRecords {
                         break
                 }
+
+                if err := cl.removeSegment(cl.segments[removed]); err != nil {
+                        return err
+                }
+                cl.counters.compacted(sizes[removed])
+                size -= sizes[removed]
+                removed++
         }
 
+        return nil
+}
+
+// compactKeys rewrites the sealed segments keeping only the latest record of every key
+// and tombstones younger than DeleteRetention. Records without a key are always kept
+// and the records left keep their offsets. Segments are read and rewritten aside without
+// holding cl.mu, which is only taken to swap in the new files.
+func (cl *CommitLog) compactKeys() error {
         cl.mu.Lock()
-        for i := 0; i < lastSegment; i++ {
-                cl.segments[i].Remove()
+        next := cl.curSegment.NextOffset()
+        segments := make([]*segment, 0, len(cl.segments))
+        candidates := make([]*segment, 0, len(cl.segments))
+        generations := make(map[*segment]uint32)
+        for _, seg := range cl.segments {
+                segments = append(segments, seg)
+                generations[seg] = atomic.LoadUint32(&seg.generation)
+                if seg != cl.curSegment && seg.compactedAt != next {
+                        candidates = append(candidates, seg)
+                }
         }
-        cl.segments = cl.segments[lastSegment:len(cl.segments)]
         cl.mu.Unlock()
+
+        // nothing was appended since every sealed segment was compacted
+        if len(candidates) == 0 {
+                return nil
+        }
+
+        latest := make(map[string]int)
+        for _, seg := range segments {
+                size, ok, err := cl.pin(seg, generations[seg])
+                if err != nil {
+                        return err
+                }
+                if !ok {
+                        continue
+                }
+
+                _, err = seg.walk(seg.headerSize(), seg.baseOffset, size, func(rec *Record, position int, record []byte) bool {
+                        if rec.Key != nil {
+                                latest[string(rec.Key)] = rec.Offset
+                        }
+                        return true
+                })
+                if cl.unpin(seg, generations[seg]) && err != nil {
+                        return err
+                }
+        }
+
+        deleteBefore := time.Now().Add(-1 * cl.options.DeleteRetention)
+
+        for _, seg := range candidates {
+                size, ok, err := cl.pin(seg, generations[seg])
+                if err != nil {
+                        return err
+                }
+                if !ok {
+                        continue
+                }
+
+                tombstones := false
+                rw, err := seg.rewrite(size, func(rec *Record) bool {
+                        if rec.Key == nil {
+                                return true
+                        }
+                        if latest[string(rec.Key)] != rec.Offset {
+                                return false
+                        }
+                        if rec.Value == nil && !rec.Timestamp.After(deleteBefore) {
+                                return false
+                        }
+                        tombstones = tombstones || rec.Value == nil
+                        return true
+                })
+
+                cl.mu.Lock()
+                unchanged := atomic.LoadUint32(&seg.generation) == generations[seg]
+                if err == nil && rw != nil && unchanged {
+                        err = seg.swap(rw)
+                        if err == nil {
+                                cl.counters.compacted(size - rw.size)
+                        }
+                } else if rw != nil {
+                        rw.discard()
+                }
+                // segments keeping tombstones are gone over again until the tombstones expire
+                if err == nil && unchanged && !tombstones {
+                        seg.compactedAt = next
+                }
+                seg.unref()
+                cl.mu.Unlock()
+
+                if err != nil && unchanged {
+                        return err
+                }
+        }
+
+        return nil
+}
+
+// pin keeps seg open while compaction reads it without cl.mu, the way an iterator does.
+// ok is false when seg was truncated or removed since compaction started, or is in a format before v3.
+func (cl *CommitLog) pin(seg *segment, generation uint32) (size int, ok bool, err error) {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        select {
+        case <- cl.closed:
+                return 0, false, ErrorClosed
+        default:
+        }
+
+        if atomic.LoadUint32(&seg.generation) != generation {
+                return 0, false, nil
+        }
+        if err := cl.acquire(seg); err != nil {
+                return 0, false, err
+        }
+        // formats before v3 do not store offsets and are never compacted
+        if seg.version != formatV3 {
+                return 0, false, nil
+        }
+        seg.refs++
+
+        size, err = seg.size()
+        if err != nil {
+                seg.unref()
+                return 0, false, err
+        }
+
+        return size, true, nil
+}
+
+// unpin releases seg after pin, it returns false when seg was truncated or removed meanwhile.
+func (cl *CommitLog) unpin(seg *segment, generation uint32) bool {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        seg.unref()
+
+        return atomic.LoadUint32(&seg.generation) == generation
+}
+
+// rewrite is a log file written aside by compaction, together with the entries of its indexes.
+type rewrite struct {
+        f               *os.File
+        path            string
+        size            int
+        offsets         []int
+        positions       []int
+        createdAts      []time.Time
+}
+
+func (rw *rewrite) discard() {
+        rw.f.Close()
+        os.Remove(rw.path)
+}
+
+// rewrite writes the records up to size which keep returns true for aside, it returns nil when all of them are kept.
+// The caller keeps seg open without holding cl.mu meanwhile and swaps the new file in with swap.
+func (seg *segment) rewrite(size int, keep func(rec *Record) bool) (*rewrite, error) {
+        // kept records of the same compressed batch are compressed together again, with the same codec
+        kept := make([][]*Record, 0)
+        keptBatch := -1
+        total, left := 0, 0
+        _, err := seg.walk(seg.headerSize(), seg.baseOffset, size, func(rec *Record, position int, record []byte) bool {
+                if keep(rec) {
+                        if rec.codec != CodecNone && position == keptBatch {
+                                kept[len(kept)-1] = append(kept[len(kept)-1], rec)
+                        } else {
+                                kept = append(kept, []*Record{rec})
+                        }
+                        keptBatch = position
+                        left++
+                }
+                total++
+                return true
+        })
+        if err != nil {
+                return nil, err
+        }
+
+        if left == total {
+                return nil, nil
+        }
+
+        path := seg.path + compactingExt
+        f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0666)
+        if err != nil {
+                return nil, err
+        }
+
+        rw := &rewrite{
+                f:              f,
+                path:           path,
+                size:           segmentHeaderSize,
+                offsets:        make([]int, 0, left),
+                positions:      make([]int, 0, left),
+                createdAts:     make([]time.Time, 0, left),
+        }
+
+        w := bufio.NewWriter(f)
+        w.Write(seg.encodeSegmentHeader(formatV3))
+
+        for _, recs := range kept {
+                record, err := seg.encodeCompacted(recs)
+                if err != nil {
+                        rw.discard()
+                        return nil, err
+                }
+
+                if _, err := w.Write(record); err != nil {
+                        rw.discard()
+                        return nil, err
+                }
+
+                for _, rec := range recs {
+                        rw.offsets = append(rw.offsets, rec.Offset - seg.baseOffset)
+                        rw.positions = append(rw.positions, rw.size)
+                        rw.createdAts = append(rw.createdAts, rec.Timestamp)
+                }
+                rw.size += len(record)
+        }
+
+        if err := w.Flush(); err != nil {
+                rw.discard()
+                return nil, err
+        }
+        if err := f.Sync(); err != nil {
+                rw.discard()
+                return nil, err
+        }
+
+        return rw, nil
+}
+
+// swap renames the file written by rewrite over the log file and rewrites the indexes. Callers hold cl.mu.
+// A crash before the indexes are rewritten is repaired by recovery the next time the segment is loaded.
+func (seg *segment) swap(rw *rewrite) error {
+        if err := os.Rename(rw.path, seg.path); err != nil {
+                rw.discard()
+                return err
+        }
+
+        // iterators go on reading the old file until they notice the new generation,
+        // compaction itself holds one of the references
+        atomic.AddUint32(&seg.generation, 1)
+        if seg.refs > 1 {
+                seg.retired = append(seg.retired, seg.f)
+        } else {
+                seg.f.Close()
+        }
+        seg.f = rw.f
+
+        if err := seg.index.reset(rw.offsets, rw.positions, nil); err != nil {
+                return err
+        }
+        if err := seg.timeindex.reset(rw.offsets, rw.createdAts); err != nil {
+                return err
+        }
+
+        // sealed segments are loaded again on their next read
+        return seg.clearCache()
+}
+
+// encodeCompacted encodes a record left by compaction, or the records left of a compressed batch.
+func (seg *segment) encodeCompacted(recs []*Record) ([]byte, error) {
+        if recs[0].codec != CodecNone {
+                codec, err := codecByID(recs[0].codec)
+                if err != nil {
+                        return nil, err
+                }
+                wrapper, err := compressBatch(codec, recs, seg.baseOffset)
+                if err != nil {
+                        return nil, err
+                }
+                return seg.encodeSegmentRecord(wrapper)
+        }
+
+        // batches of sealed segments have long been complete
+        rec := recs[0]
+        rec.attributes &^= attrBatchContinued
+
+        return seg.encodeSegmentRecord(rec)
 }
@@ -0,0 +1,320 @@
+package commitlog
+
+import (
+        "os"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+func TestCompactKeys(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         70, //two records per segment
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        old := time.Now().Add(-48 * time.Hour)
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`a`)})             //0, superseded by 6
+        cl.AppendRecord(&Record{Key: []byte(`k2`), Value: []byte(`b`)})             //1, superseded by 4
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`c`)})             //2, superseded by 6
+        cl.AppendRecord(&Record{Key: []byte(`k3`), Value: []byte(`d`)})             //3
+        cl.AppendRecord(&Record{Key: []byte(`k2`), Timestamp: old})                 //4, expired tombstone
+        cl.AppendRecord(&Record{Key: []byte(`k4`)})                                 //5, tombstone
+        cl.Append([]byte(`e`))                                                      //6, no key
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`f`)})             //7
+
+        cl.Compact()
+
+        for _, offset := range []int{0, 1, 2, 4} {
+                if _, err := cl.Read(offset); err != ErrorRecordCompacted {
+                        t.Errorf("Expect ErrorRecordCompacted for offset %v, but got: %v", offset, err)
+                }
+        }
+
+        expect := map[int]string{3: `d`, 6: `e`, 7: `f`}
+        for offset, value := range expect {
+                if data, err := cl.Read(offset); err != nil || string(data) != value {
+                        t.Errorf("Expect %v at offset %v, but got: %s, %v", value, offset, data, err)
+                }
+        }
+
+        if rec, err := cl.ReadRecord(5); err != nil || rec.Value != nil {
+                t.Errorf("Expect the recent tombstone to be kept, but got: %+v, %v", rec, err)
+        }
+
+        if offset, _ := cl.Append([]byte(`g`)); offset != 8 {
+                t.Errorf("Expect next offset: 8, but got: %v", offset)
+        }
+
+        it := cl.NewIterator(0)
+        offsets := make([]int, 0)
+        for it.Next() {
+                offsets = append(offsets, it.Record().Offset)
+        }
+        it.Close()
+        if len(offsets) != 5 || offsets[0] != 3 || offsets[1] != 5 || offsets[2] != 6 {
+                t.Errorf("Expect to iterate over offsets 3 5 6 7 8, but got: %v", offsets)
+        }
+}
+
+func TestCompactKeysReopen(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         70,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`a`)})
+        cl.AppendRecord(&Record{Key: []byte(`k2`), Value: []byte(`b`)})
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`c`)})
+        cl.Compact()
+        cl.Close()
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if _, err := cl.Read(0); err != ErrorRecordCompacted {
+                t.Errorf("Expect ErrorRecordCompacted but got: %v", err)
+        }
+        if data, err := cl.Read(1); err != nil || string(data) != `b` {
+                t.Errorf("Expect b but got: %s, %v", data, err)
+        }
+        if reports := cl.Recoveries(); len(reports) != 0 {
+                t.Errorf("Expect no recovery of the compacted segment, but got: %+v", reports[0])
+        }
+}
+
+func TestRetentionBytes(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         80, //two records per segment
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                RetentionBytes:         160,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(`0123456789`)) //8 + 34 + 34 bytes per full segment
+        }
+
+        cl.Compact()
+
+        // 3 * 76 + 42 bytes down to 76 + 42
+        if len(cl.segments) != 2 || cl.segments[0].baseOffset != 4 {
+                t.Errorf("Expect segments 4 and 6 to be left, but got %v segments from %v", len(cl.segments), cl.segments[0].baseOffset)
+        }
+        if _, err := cl.Read(3); err != ErrorSegmentNotFound {
+                t.Errorf("Expect ErrorSegmentNotFound but got: %v", err)
+        }
+        if _, err := cl.Read(4); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+}
+
+func TestRetentionKeepsFailedSegments(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         80,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        time.Hour,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        old := time.Now().Add(-48 * time.Hour)
+        for i := 0; i < 5; i++ {
+                cl.AppendRecord(&Record{Value: []byte(`0123456789`), Timestamp: old})
+        }
+
+        // removing segment 2 fails as its log file is gone already
+        if err := os.Remove(cl.segments[1].path); err != nil {
+                t.Fatal(err)
+        }
+
+        if err := cl.Compact(); err == nil {
+                t.Errorf("Expect an error but got: %v", err)
+        }
+        if len(cl.segments) != 2 || cl.segments[0].baseOffset != 2 {
+                t.Errorf("Expect segments 2 and 4 to be left, but got %v segments from %v", len(cl.segments), cl.segments[0].baseOffset)
+        }
+        if n := atomic.LoadUint64(&cl.counters.compactionErrors); n != 1 {
+                t.Errorf("Expect 1 compaction error but got: %v", n)
+        }
+}
+
+func TestRetentionRecords(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         80,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                RetentionRecords:       1,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 4; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+
+        cl.Compact()
+
+        // the active segment holding 2 records is never removed
+        if len(cl.segments) != 1 || cl.segments[0] != cl.curSegment {
+                t.Errorf("Expect the active segment only to be left, but got %v segments", len(cl.segments))
+        }
+        if offset := cl.Offset(); offset != 3 {
+                t.Errorf("Expect offset: 3, but got: %v", offset)
+        }
+}
+
+func TestCompactKeysTruncate(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         140, //five records per segment
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 12; i++ {
+                cl.AppendRecord(&Record{Key: []byte{'a' + byte(i % 2)}, Value: []byte(`v`)})
+        }
+        if len(cl.segments) != 3 {
+                t.Errorf("Expect 3 segments but got: %v", len(cl.segments))
+        }
+
+        cl.Compact()
+
+        if err := cl.Truncate(4); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        if offset := cl.Offset(); offset != 3 {
+                t.Errorf("Expect offset: 3 after truncation, but got: %v", offset)
+        }
+
+        cl.Close()
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if offset := cl.Offset(); offset != 3 {
+                t.Errorf("Expect offset: 3 after reopening, but got: %v", offset)
+        }
+        if offset, _ := cl.Append([]byte(`w`)); offset != 4 {
+                t.Errorf("Expect next offset: 4, but got: %v", offset)
+        }
+}
+
+func TestCompactKeysWhileIterating(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         100 * 1024,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        value := make([]byte, 10 * 1024)
+        for i := 0; i < 60; i++ {
+                cl.AppendRecord(&Record{Key: []byte{'a' + byte(i % 2)}, Value: value})
+        }
+
+        it := cl.NewIterator(0)
+        defer it.Close()
+
+        if !it.Next() || it.Record().Offset != 0 {
+                t.Errorf("Expect to read record 0")
+        }
+
+        cl.Compact()
+
+        last := 0
+        for it.Next() {
+                if it.Record().Offset <= last {
+                        t.Errorf("Expect offsets to go up but got: %v after %v", it.Record().Offset, last)
+                }
+                last = it.Record().Offset
+        }
+        if err := it.Err(); err != nil || last != 59 {
+                t.Errorf("Expect to read up to offset 59 but got: %v, %v", last, err)
+        }
+
+        // nothing was appended since, the sealed segments are left alone
+        generation := cl.segments[0].generation
+        cl.Compact()
+        if seg := cl.segments[0]; seg.generation != generation || seg.compactedAt != 60 {
+                t.Errorf("Expect the compacted segment to be skipped but got generation %v, compacted at %v", seg.generation, seg.compactedAt)
+        }
+}
+
+func TestCompactKeysWhileAppending(t *testing.T) {
+        options := &Options{
+                MaxSegmentSize:         1024,
+                CompactionInterval:     time.Hour,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+        }
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        done := make(chan bool)
+        go func() {
+                for i := 0; i < 20; i++ {
+                        cl.Compact()
+                }
+                close(done)
+        }()
+
+        for i := 0; i < 300; i++ {
+                if offset, err := cl.AppendRecord(&Record{Key: []byte{'a' + byte(i % 3)}, Value: []byte(`value`)}); err != nil || offset != i {
+                        t.Errorf("Expect offset %v but got: %v, %v", i, offset, err)
+                }
+        }
+        <-done
+        cl.Compact()
+
+        for _, offset := range []int{297, 298, 299} {
+                if data, err := cl.Read(offset); err != nil || string(data) != `value` {
+                        t.Errorf("Expect the latest record of every key at %v but got: %s, %v", offset, data, err)
+                }
+        }
+        if _, err := cl.Read(0); err != ErrorRecordCompacted {
+                t.Errorf("Expect ErrorRecordCompacted but got: %v", err)
+        }
+}
@@ -0,0 +1,109 @@
+package commitlog
+
+import (
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/rand"
+        "errors"
+        "io"
+        "sync"
+)
+
+var (
+        ErrorKeyNotFound = errors.New("Encryption key not found")
+        ErrorNoEncryption = errors.New("Segment is encrypted but no encryption is configured")
+        ErrorDecryptRecord = errors.New("Record cannot be decrypted")
+)
+
+// Encryption encrypts the values of records with AES-GCM. Compressed batches are compressed first
+// and encrypted as a whole. Keys, headers, timestamps and the index files are left in plaintext.
+type Encryption struct {
+        Keys            KeyProvider
+}
+
+// KeyProvider hands out AES keys of 16, 24 or 32 bytes. Every segment is encrypted with the key
+// which was current when it was created and stores its id, so that old segments stay readable
+// once the current key has been rotated.
+type KeyProvider interface {
+        CurrentKey() (id uint16, key []byte, err error)
+        Key(id uint16) ([]byte, error)
+}
+
+// MemoryKeyProvider keeps keys in memory, the last key added is the current one.
+type MemoryKeyProvider struct {
+        mu              sync.Mutex
+        current         uint16
+        keys            map[uint16][]byte
+}
+
+func NewMemoryKeyProvider() *MemoryKeyProvider {
+        return &MemoryKeyProvider{keys: make(map[uint16][]byte)}
+}
+
+// AddKey adds key under id and makes it the current key.
+func (p *MemoryKeyProvider) AddKey(id uint16, key []byte) {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+
+        p.keys[id] = key
+        p.current = id
+}
+
+func (p *MemoryKeyProvider) CurrentKey() (uint16, []byte, error) {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+
+        key, ok := p.keys[p.current]
+        if !ok {
+                return 0, nil, ErrorKeyNotFound
+        }
+
+        return p.current, key, nil
+}
+
+func (p *MemoryKeyProvider) Key(id uint16) ([]byte, error) {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+
+        key, ok := p.keys[id]
+        if !ok {
+                return nil, ErrorKeyNotFound
+        }
+
+        return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+        block, err := aes.NewCipher(key)
+        if err != nil {
+                return nil, err
+        }
+
+        return cipher.NewGCM(block)
+}
+
+// Encrypted value
+// + ----------- + -------------------------- +
+// | Nonce (12B) | Ciphertext | GCM Tag (16B) |
+// + ----------- + -------------------------- +
+func encryptValue(aead cipher.AEAD, value []byte) ([]byte, error) {
+        nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(value) + aead.Overhead())
+        if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+                return nil, err
+        }
+
+        return aead.Seal(nonce, nonce, value, nil), nil
+}
+
+func decryptValue(aead cipher.AEAD, value []byte) ([]byte, error) {
+        if len(value) < aead.NonceSize() {
+                return nil, ErrorDecryptRecord
+        }
+
+        plain, err := aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], nil)
+        if err != nil {
+                return nil, ErrorDecryptRecord
+        }
+
+        return plain, nil
+}
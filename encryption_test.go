@@ -0,0 +1,122 @@
+package commitlog
+
+import (
+        "bytes"
+        "io/ioutil"
+        "testing"
+        "time"
+)
+
+func newTestKeys() *MemoryKeyProvider {
+        keys := NewMemoryKeyProvider()
+        keys.AddKey(1, bytes.Repeat([]byte{1}, 32))
+
+        return keys
+}
+
+func TestEncryption(t *testing.T) {
+        keys := newTestKeys()
+        options := &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: keys}}
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`secret payload`))
+        cl.AppendRecord(&Record{Key: []byte(`k`)})
+
+        data, _ := ioutil.ReadFile(cl.curSegment.path)
+        if bytes.Contains(data, []byte(`secret payload`)) {
+                t.Errorf("Expect the value not to be stored in plaintext")
+        }
+
+        if data, err := cl.Read(0); err != nil || string(data) != `secret payload` {
+                t.Errorf("Expect to read back the decrypted value but got: %s, %v", data, err)
+        }
+        if rec, err := cl.ReadRecord(1); err != nil || rec.Value != nil {
+                t.Errorf("Expect a tombstone to stay nil but got: %+v, %v", rec, err)
+        }
+
+        cl.Close()
+
+        if _, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}); err != ErrorNoEncryption {
+                t.Errorf("Expect ErrorNoEncryption but got: %v", err)
+        }
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        if data, err := cl.Read(0); err != nil || string(data) != `secret payload` {
+                t.Errorf("Expect to read back the decrypted value after reopening but got: %s, %v", data, err)
+        }
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+        keys := newTestKeys()
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: keys}})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`a`))
+        keys.AddKey(2, bytes.Repeat([]byte{2}, 16))
+
+        // the next segment is encrypted with the new key
+        for i := 0; i < 3; i++ {
+                cl.Append([]byte(`0123456789012345678901234567890123456789`))
+        }
+
+        if first, last := cl.segments[0].keyID, cl.curSegment.keyID; first != 1 || last != 2 {
+                t.Errorf("Expect key ids 1 and 2 but got: %v, %v", first, last)
+        }
+
+        for i := 0; i < 4; i++ {
+                if _, err := cl.Read(i); err != nil {
+                        t.Errorf("Expect to read offset %v but got: %v", i, err)
+                }
+        }
+}
+
+func TestEncryptionWithCodec(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: newTestKeys()}, Codec: GzipCodec})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendBatch([][]byte{[]byte(`a`), []byte(`b`), []byte(`c`)})
+
+        it := cl.NewIterator(0)
+        values := make([]string, 0)
+        for it.Next() {
+                values = append(values, string(it.Record().Value))
+        }
+        it.Close()
+
+        if len(values) != 3 || values[0] != `a` || values[2] != `c` || it.Err() != nil {
+                t.Errorf("Expect to iterate over a, b, c but got: %v, %v", values, it.Err())
+        }
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+        keys := newTestKeys()
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: keys}})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`a`))
+        cl.Close()
+
+        wrong := NewMemoryKeyProvider()
+        wrong.AddKey(1, bytes.Repeat([]byte{9}, 32))
+
+        // the records are kept rather than truncated as corrupted
+        if _, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: wrong}}); err != ErrorDecryptRecord {
+                t.Errorf("Expect ErrorDecryptRecord but got: %v", err)
+        }
+}
@@ -0,0 +1,115 @@
+package commitlog
+
+// AppendFuture is the result of AppendAsync, it resolves once the record is on disk or failed to be appended.
+type AppendFuture struct {
+        rec             *Record
+        done            chan struct{}
+        offset          int
+        err             error
+}
+
+// Done is closed once the future is resolved.
+func (f *AppendFuture) Done() <-chan struct{} {
+        return f.done
+}
+
+// Wait blocks until the record is on disk and returns its offset.
+func (f *AppendFuture) Wait() (int, error) {
+        <-f.done
+
+        return f.offset, f.err
+}
+
+func (f *AppendFuture) resolve(offset int, err error) {
+        f.offset, f.err = offset, err
+        close(f.done)
+}
+
+// AppendAsync appends a record like AppendRecord, but without waiting for it.
+// The future resolves once the record is fsynced, whatever the SyncPolicy. Concurrent appends are
+// merged by a group commit loop into a single write and a single fsync, so that many writers get
+// durable appends without paying for one fsync each.
+func (cl *CommitLog) AppendAsync(rec *Record) *AppendFuture {
+        f := &AppendFuture{rec: rec, done: make(chan struct{})}
+
+        if err := cl.checkRecord(rec); err != nil {
+                f.resolve(0, err)
+                return f
+        }
+
+        select {
+        case cl.pending <- f:
+        case <- cl.closed:
+                f.resolve(0, ErrorClosed)
+        }
+
+        return f
+}
+
+// groupCommit takes the appends which queued up while the previous group was being written and synced
+// and commits them together, a group stops growing once it would fill a segment.
+func (cl *CommitLog) groupCommit() {
+        for {
+                select {
+                case <- cl.closed:
+                        return
+                case f := <- cl.pending:
+                        group := []*AppendFuture{f}
+                        size := recordV3Size(f.rec)
+
+                collect:
+                        for size < cl.options.MaxSegmentSize {
+                                select {
+                                case f := <- cl.pending:
+                                        group = append(group, f)
+                                        size += recordV3Size(f.rec)
+                                default:
+                                        break collect
+                                }
+                        }
+
+                        cl.commitGroup(group)
+                }
+        }
+}
+
+func (cl *CommitLog) commitGroup(group []*AppendFuture) {
+        recs := make([]*Record, len(group))
+        for i, f := range group {
+                recs[i] = f.rec
+        }
+
+        first, err := cl.writeGroup(recs)
+        if err != nil {
+                for _, f := range group {
+                        f.resolve(0, err)
+                }
+                return
+        }
+
+        // waiting for followers does not hold up the next group
+        go func() {
+                err := cl.waitAcks(first + len(group) - 1)
+                for i, f := range group {
+                        f.resolve(first + i, err)
+                }
+        }()
+}
+
+func (cl *CommitLog) writeGroup(recs []*Record) (int, error) {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        select {
+        case <- cl.closed:
+                return 0, ErrorClosed
+        default:
+        }
+
+        first, _, err := cl.writeRecords(recs)
+        if err != nil {
+                return 0, err
+        }
+
+        return first, cl.sync()
+}
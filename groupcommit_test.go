@@ -0,0 +1,83 @@
+package commitlog
+
+import (
+        "bytes"
+        "sync"
+        "testing"
+        "time"
+)
+
+func TestAppendAsync(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        var wg sync.WaitGroup
+        offsets := make([]int, 100)
+        for i := range offsets {
+                wg.Add(1)
+                go func(i int) {
+                        defer wg.Done()
+
+                        offset, err := cl.AppendAsync(&Record{Value: []byte(`0123456789`)}).Wait()
+                        if err != nil {
+                                t.Errorf("Expect nil error but got: %v", err)
+                        }
+                        offsets[i] = offset
+                }(i)
+        }
+        wg.Wait()
+
+        seen := make(map[int]bool)
+        for _, offset := range offsets {
+                seen[offset] = true
+        }
+        if len(seen) != 100 || cl.Offset() != 99 {
+                t.Errorf("Expect 100 distinct offsets up to 99 but got: %v, %v", len(seen), cl.Offset())
+        }
+
+        for i := 0; i < 100; i++ {
+                if data, err := cl.Read(i); err != nil || !bytes.Equal([]byte(`0123456789`), data) {
+                        t.Errorf("Expect to read back offset %v but got: %v, %v", i, data, err)
+                }
+        }
+
+        if cl.unsynced != 0 {
+                t.Errorf("Expect every async append to be synced but got: %v unsynced", cl.unsynced)
+        }
+}
+
+func TestAppendAsyncTooLarge(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, MaxRecordSize: 100})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if _, err := cl.AppendAsync(&Record{Value: make([]byte, 100)}).Wait(); err != ErrorExceedMaxRecordSize {
+                t.Errorf("Expect ErrorExceedMaxRecordSize but got: %v", err)
+        }
+}
+
+func TestAppendAsyncClosed(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Close()
+
+        f := cl.AppendAsync(&Record{Value: []byte(`abc`)})
+        select {
+        case <- f.Done():
+        case <- time.After(time.Second):
+                t.Fatalf("Expect the future to resolve after Close")
+        }
+
+        if _, err := f.Wait(); err != ErrorClosed {
+                t.Errorf("Expect ErrorClosed but got: %v", err)
+        }
+}
@@ -2,23 +2,43 @@ package commitlog
 
 import (
         "bufio"
+        "bytes"
         "encoding/binary"
         "fmt"
         "io/ioutil"
         "os"
         "path/filepath"
+        "sort"
 )
 
 const (
         IndexExt = ".index"
+
+        indexHeaderSize = 8
+        indexEntrySize  = 8
+)
+
+var (
+        indexMagic = []byte("CLIX")
 )
 
+// Index is a sparse index of a segment. It holds an entry every IndexIntervalBytes of the log file,
+// the first record of a segment is always indexed.
 type Index struct {
         Path            string
         f               *os.File
         writer          *bufio.Writer
         baseOffset      int
-        data            map[int]int //in-momery index data
+        interval        int
+        entries         []indexEntry //in-momery index data, in offset order
+        mapped          []byte       //the index file mapped into memory, in place of entries for sealed segments
+        isMapped        bool
+        stale           bool         //the index file is in an older format or torn, it has to be rebuilt from the log file
+}
+
+type indexEntry struct {
+        offset          int //relative to the segment
+        position        int
 }
 
 func NewIndex(dir string, offset int, options *Options) (*Index, error) {
@@ -35,71 +55,307 @@ func NewIndex(dir string, offset int, options *Options) (*Index, error) {
                 f:              f,
                 writer:         bufio.NewWriter(f),
                 baseOffset:     offset,
-                data:           make(map[int]int),
+                interval:       DefaultIndexIntervalBytes,
+        }
+        if options != nil && options.IndexIntervalBytes > 0 {
+                idx.interval = options.IndexIntervalBytes
+        }
+
+        fi, err := f.Stat()
+        if err != nil {
+                return nil, err
+        }
+        if fi.Size() == 0 {
+                if err := idx.writeHeader(); err != nil {
+                        return nil, err
+                }
         }
 
         return idx, nil
 }
 
+// Index header
+// + ---------- + ------------ + ------------- +
+// | Magic (4B) | Version (1B) | Reserved (3B) |
+// + ---------- + ------------ + ------------- +
+func (idx *Index) writeHeader() error {
+        buf := make([]byte, indexHeaderSize)
+
+        copy(buf, indexMagic)
+        buf[4] = 1
+
+        _, err := idx.f.Write(buf)
+
+        return err
+}
+
 //Populate in-memory data, loading from disk
 func (idx *Index) Load() error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
+        if _, err := idx.f.Seek(0, 0); err != nil {
+                return err
+        }
+
         data, err := ioutil.ReadAll(idx.f)
         if err != nil {
                 return err
         }
 
-        for len(data) > 0 {
-                offset, o := binary.Uvarint(data)
-                data = data[o:]
+        idx.entries = make([]indexEntry, 0, len(data) / indexEntrySize)
+        idx.stale = len(data) < indexHeaderSize || !bytes.Equal(data[:4], indexMagic) || (len(data) - indexHeaderSize) % indexEntrySize != 0
+        if idx.stale {
+                return nil
+        }
+
+        for data = data[indexHeaderSize:]; len(data) > 0; data = data[indexEntrySize:] {
+                idx.entries = append(idx.entries, indexEntry{
+                        offset:         int(binary.LittleEndian.Uint32(data[:4])),
+                        position:       int(binary.LittleEndian.Uint32(data[4:8])),
+                })
+        }
+
+        return nil
+}
+
+// mmap maps the index file into memory instead of loading its entries onto the heap.
+// It is meant for sealed segments, whose index does not change anymore.
+func (idx *Index) mmap() error {
+        if err := idx.Sync(); err != nil {
+                return err
+        }
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
+        fi, err := idx.f.Stat()
+        if err != nil {
+                return err
+        }
+        size := int(fi.Size())
 
-                position, p := binary.Uvarint(data)
-                data = data[p:]
+        idx.entries = nil
+        idx.stale = size < indexHeaderSize || (size - indexHeaderSize) % indexEntrySize != 0
+        if idx.stale {
+                return nil
+        }
 
-                idx.data[int(offset)] = int(position)
+        data, err := mmapFile(idx.f, size)
+        if err != nil {
+                return err
         }
+        if !bytes.Equal(data[:4], indexMagic) {
+                idx.stale = true
+                return munmapFile(data)
+        }
+
+        idx.mapped = data
+        idx.isMapped = true
 
         return nil
 }
 
+func (idx *Index) unmap() error {
+        if !idx.isMapped {
+                return nil
+        }
+
+        data := idx.mapped
+        idx.mapped = nil
+        idx.isMapped = false
+
+        return munmapFile(data)
+}
+
+// Count returns the number of entries.
 func (idx *Index) Count() int {
-        return len(idx.data)
+        if idx.isMapped {
+                return (len(idx.mapped) - indexHeaderSize) / indexEntrySize
+        }
+
+        return len(idx.entries)
+}
+
+// entry returns the i-th entry, from the mapped index file or from memory.
+func (idx *Index) entry(i int) indexEntry {
+        if !idx.isMapped {
+                return idx.entries[i]
+        }
+
+        data := idx.mapped[indexHeaderSize + i * indexEntrySize:]
+
+        return indexEntry{
+                offset:         int(binary.LittleEndian.Uint32(data[:4])),
+                position:       int(binary.LittleEndian.Uint32(data[4:8])),
+        }
 }
 
+// Write indexes the record at offset when it starts at least IndexIntervalBytes after the last indexed one.
 func (idx *Index) Write(offset int, position int) error {
+        if !isIndexed(idx.entries, position, idx.interval) {
+                return nil
+        }
+
+        return idx.writeEntry(offset, position)
+}
+
+func (idx *Index) writeEntry(offset int, position int) error {
         data := idx.encodeIndexRecord(offset, position)
         _, err := idx.writer.Write(data)
 
-        idx.data[offset] = position
+        idx.entries = append(idx.entries, indexEntry{offset, position})
 
         return err
 }
 
+func isIndexed(entries []indexEntry, position int, interval int) bool {
+        return len(entries) == 0 || position - entries[len(entries)-1].position >= interval
+}
+
+// Index record
+// + ---------------------- + ------------- +
+// | Relative Offset (4B)   | Position (4B) |
+// + ---------------------- + ------------- +
 func (idx *Index) encodeIndexRecord(offset int, position int) []byte {
-        buf := make([]byte, binary.MaxVarintLen64)
+        buf := make([]byte, indexEntrySize)
 
-        of := binary.PutUvarint(buf, uint64(offset))
-        pos := binary.PutUvarint(buf[of:], uint64(position))
+        binary.LittleEndian.PutUint32(buf[:4], uint32(offset))
+        binary.LittleEndian.PutUint32(buf[4:], uint32(position))
 
-        return buf[:of+pos]
+        return buf
 }
 
+// Get returns the position of the record at offset when it is indexed.
 func (idx *Index) Get(offset int) (int, bool) {
-        pos, found := idx.data[offset]
+        n := idx.Count()
+        i := sort.Search(n, func(i int) bool {
+                return idx.entry(i).offset >= offset
+        })
+
+        if i < n && idx.entry(i).offset == offset {
+                return idx.entry(i).position, true
+        }
 
-        return pos, found
+        return -1, false
 }
 
-func (idx *Index) clearCache() error {
-        idx.data = make(map[int]int)
+// lookup returns the closest entry at or before offset, ok is false when there is none.
+func (idx *Index) lookup(offset int) (entry indexEntry, ok bool) {
+        i := sort.Search(idx.Count(), func(i int) bool {
+                return idx.entry(i).offset > offset
+        })
+
+        if i == 0 {
+                return indexEntry{}, false
+        }
+
+        return idx.entry(i-1), true
+}
+
+func (idx *Index) last() (indexEntry, bool) {
+        n := idx.Count()
+        if n == 0 {
+                return indexEntry{}, false
+        }
+
+        return idx.entry(n-1), true
+}
+
+// rebuild rewrites the index file from the records found in the log file
+// and returns how many entries were missing or wrong.
+func (idx *Index) rebuild(offsets []int, positions []int, resumes map[int]bool) (int, error) {
+        entries := make([]indexEntry, 0)
+        for i, offset := range offsets {
+                if resumes[positions[i]] || isIndexed(entries, positions[i], idx.interval) {
+                        entries = append(entries, indexEntry{offset, positions[i]})
+                }
+        }
+
+        repaired := 0
+        for _, entry := range entries {
+                if pos, ok := idx.Get(entry.offset); !ok || pos != entry.position {
+                        repaired++
+                }
+        }
+
+        if !idx.stale && repaired == 0 && idx.Count() == len(entries) {
+                return 0, nil
+        }
+
+        return repaired, idx.reset(offsets, positions, resumes)
+}
+
+// reset replaces all entries of the index file by indexing the records at offsets and positions.
+// The records at resumes, which follow corrupted ones, are indexed whatever the interval.
+func (idx *Index) reset(offsets []int, positions []int, resumes map[int]bool) error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+        if err := idx.f.Truncate(0); err != nil {
+                return err
+        }
+        idx.writer.Reset(idx.f)
+        if err := idx.writeHeader(); err != nil {
+                return err
+        }
+
+        idx.entries = make([]indexEntry, 0)
+        idx.stale = false
+
+        for i, offset := range offsets {
+                write := idx.Write
+                if resumes[positions[i]] {
+                        write = idx.writeEntry
+                }
+                if err := write(offset, positions[i]); err != nil {
+                        return err
+                }
+        }
+
+        return idx.Sync()
+}
+
+// truncate drops the entries at or after offset.
+func (idx *Index) truncate(offset int) error {
+        if err := idx.Sync(); err != nil {
+                return err
+        }
+        // the entries go back onto the heap, the index file is about to change
+        if idx.isMapped {
+                if err := idx.Load(); err != nil {
+                        return err
+                }
+        }
+
+        i := sort.Search(len(idx.entries), func(i int) bool {
+                return idx.entries[i].offset >= offset
+        })
+
+        if err := idx.f.Truncate(int64(indexHeaderSize + i * indexEntrySize)); err != nil {
+                return err
+        }
+        idx.entries = idx.entries[:i]
 
         return nil
 }
 
+func (idx *Index) clearCache() error {
+        idx.entries = nil
+
+        return idx.unmap()
+}
+
 func (idx *Index) Sync() error {
         return idx.writer.Flush()
 }
 
 func (idx *Index) Close() error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
         return idx.f.Close()
 }
 
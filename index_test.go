@@ -58,6 +58,73 @@ func TestReopen(t *testing.T) {
         }
 }
 
+func TestSparseIndex(t *testing.T) {
+        setupDir(INDEX_DIR)
+        defer cleanupDir(INDEX_DIR)
+
+        index, err := NewIndex(INDEX_DIR, 0, &Options{IndexIntervalBytes: 100})
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 10; i++ {
+                index.Write(i, 8 + i * 40)
+        }
+        index.Sync()
+        index.Load()
+
+        // records start at 8, 48, 88, 128, ... only every third one is indexed
+        if index.Count() != 4 {
+                t.Errorf("Expect 4 entries but got: %v", index.Count())
+        }
+
+        if _, ok := index.Get(1); ok {
+                t.Errorf("Expect offset 1 not to be indexed")
+        }
+
+        entry, ok := index.lookup(5)
+        if !ok || entry.offset != 3 || entry.position != 128 {
+                t.Errorf("Expect entry of offset 3 at 128 but got: %+v", entry)
+        }
+
+        if err := index.truncate(4); err != nil {
+                t.Error(err)
+        }
+        index.Load()
+        if index.Count() != 2 {
+                t.Errorf("Expect 2 entries after truncate but got: %v", index.Count())
+        }
+}
+
+func TestRebuildLegacyIndex(t *testing.T) {
+        setupDir(INDEX_DIR)
+        defer cleanupDir(INDEX_DIR)
+
+        // an index file in the old format, without a header
+        f, _ := os.Create(INDEX_DIR + "/00000000000000000000" + IndexExt)
+        f.Write([]byte{0x00, 0x00, 0x01, 0x02})
+        f.Close()
+
+        index, err := NewIndex(INDEX_DIR, 0, nil)
+        if err != nil {
+                t.Error(err)
+        }
+        index.Load()
+
+        repaired, err := index.rebuild([]int{0, 1}, []int{8, 20}, nil)
+        if err != nil {
+                t.Error(err)
+        }
+        if repaired != 1 {
+                t.Errorf("Expect 1 repaired entry but got: %v", repaired)
+        }
+
+        index.Load()
+        if pos, ok := index.Get(0); !ok || pos != 8 {
+                t.Errorf("Expect 8 but got: %v", pos)
+        }
+}
+
 func setupDir(path string) {
         os.MkdirAll(path, 0755)
 }
@@ -0,0 +1,283 @@
+package commitlog
+
+import (
+        "bytes"
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Inspection reads the files of a log directory directly, without opening the log, so it also works
+// while the owning process is down. Nothing is written, a torn tail is reported rather than repaired.
+
+var (
+        ErrorInvalidIndex = errors.New("Index file is in an older format or torn")
+)
+
+// SegmentInfo describes a segment as found on disk.
+type SegmentInfo struct {
+        BaseOffset      int
+        Path            string
+        Version         int       // segment format version
+        KeyID           int       // id of the key the values are encrypted with, -1 for plaintext
+        Size            int       // bytes of the log file
+        Records         int       // complete records, a compressed batch of a segment inspected without its key counts once
+        FirstOffset     int       // -1 when there are no records
+        LastOffset      int       // -1 when there are no records
+        FirstTime       time.Time // zero when there are no records
+        LastTime        time.Time
+        TornBytes       int       // bytes after the last complete record, left behind by a crash or corruption
+        CorruptedBytes  int       // bytes of corrupted records followed by complete ones, see IssueCorruptRecord
+}
+
+// IndexEntry is an entry of the sparse index of a segment.
+type IndexEntry struct {
+        Offset          int
+        Position        int // byte position of the record in the log file
+}
+
+// TimeIndexEntry is an entry of the time index of a segment, times have second precision.
+type TimeIndexEntry struct {
+        Time            time.Time
+        Offset          int
+}
+
+// SegmentOffsets returns the base offsets of the segments in dir in order.
+func SegmentOffsets(dir string) ([]int, error) {
+        files, err := ioutil.ReadDir(dir)
+        if err != nil {
+                return nil, err
+        }
+
+        offsets := make([]int, 0)
+        for _, file := range files {
+                if !strings.HasSuffix(file.Name(), SegExt) {
+                        continue
+                }
+
+                offset, err := strconv.Atoi(strings.TrimSuffix(file.Name(), SegExt))
+                if err != nil {
+                        return nil, err
+                }
+                offsets = append(offsets, offset)
+        }
+
+        return offsets, nil
+}
+
+// Segments scans every segment in dir. options are only needed to decrypt, they may be nil.
+func Segments(dir string, options *Options) ([]*SegmentInfo, error) {
+        offsets, err := SegmentOffsets(dir)
+        if err != nil {
+                return nil, err
+        }
+
+        infos := make([]*SegmentInfo, 0, len(offsets))
+        for _, offset := range offsets {
+                info, err := inspect(dir, offset, options, nil, nil)
+                if err != nil {
+                        return nil, err
+                }
+                infos = append(infos, info)
+        }
+
+        return infos, nil
+}
+
+// inspect walks the segment at offset, fn is called with every record and its position when it is not nil.
+// Corrupted records in the middle of the log file are stepped over, corrupted is called with their position
+// and size when it is not nil.
+func inspect(dir string, offset int, options *Options, fn func(rec *Record, position int), corrupted func(position int, size int)) (*SegmentInfo, error) {
+        seg, err := inspectSegment(dir, offset, options)
+        if err != nil {
+                return nil, err
+        }
+        defer seg.f.Close()
+
+        info := &SegmentInfo{
+                BaseOffset:     offset,
+                Path:           seg.path,
+                Version:        seg.version,
+                KeyID:          seg.keyID,
+                Size:           seg.position,
+                FirstOffset:    -1,
+                LastOffset:     -1,
+        }
+
+        // an unusable index only leaves corrupted records whose size is torn too without a place to go on from
+        entries := make([]indexEntry, 0)
+        if indexEntries, err := IndexEntries(dir, offset); err == nil {
+                for _, entry := range indexEntries {
+                        entries = append(entries, indexEntry{entry.Offset - offset, entry.Position})
+                }
+        }
+
+        end, err := seg.walkCorrupted(seg.headerSize(), offset, seg.position, entries, func(rec *Record, position int, record []byte) bool {
+                if info.Records == 0 {
+                        info.FirstOffset = rec.Offset
+                        info.FirstTime = rec.Timestamp
+                }
+                info.Records++
+                info.LastOffset = rec.Offset
+                info.LastTime = rec.Timestamp
+                if fn != nil {
+                        fn(rec, position)
+                }
+                return true
+        }, func(position int, size int) {
+                info.CorruptedBytes += size
+                if corrupted != nil {
+                        corrupted(position, size)
+                }
+        })
+        if err != nil {
+                return nil, err
+        }
+        if end < seg.position {
+                info.TornBytes = seg.position - end
+        }
+
+        return info, nil
+}
+
+// ScanDir calls fn with the records of dir from offset onwards until fn returns false.
+// It returns the offset after the last record passed to fn, offset when there was none,
+// so that a later call picks up the records appended meanwhile.
+func ScanDir(dir string, offset int, options *Options, fn func(rec *Record) bool) (int, error) {
+        offsets, err := SegmentOffsets(dir)
+        if err != nil {
+                return offset, err
+        }
+
+        next := offset
+        for i, base := range offsets {
+                if i + 1 < len(offsets) && offsets[i+1] <= offset {
+                        continue
+                }
+
+                seg, err := inspectSegment(dir, base, options)
+                if err != nil {
+                        return next, err
+                }
+
+                // start from the closest index entry, the whole log file is walked when the index is unusable
+                position, current := seg.headerSize(), base
+                if entries, err := IndexEntries(dir, base); err == nil {
+                        for _, entry := range entries {
+                                if entry.Offset <= offset && entry.Position < seg.position {
+                                        position, current = entry.Position, entry.Offset
+                                }
+                        }
+                }
+
+                stop, sealed := false, false
+                _, err = seg.walk(position, current, seg.position, func(rec *Record, position int, record []byte) bool {
+                        if rec.Offset < offset {
+                                return true
+                        }
+                        if rec.attributes & attrEncrypted != 0 {
+                                sealed = true
+                                return false
+                        }
+
+                        next = rec.Offset + 1
+                        if !fn(rec) {
+                                stop = true
+                                return false
+                        }
+                        return true
+                })
+                seg.f.Close()
+
+                if err == nil && sealed {
+                        err = ErrorNoEncryption
+                }
+                if err != nil || stop {
+                        return next, err
+                }
+        }
+
+        return next, nil
+}
+
+// IndexEntries reads the sparse index of the segment at offset.
+func IndexEntries(dir string, offset int) ([]IndexEntry, error) {
+        data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%020d", offset) + IndexExt))
+        if err != nil {
+                return nil, err
+        }
+
+        if len(data) < indexHeaderSize || !bytes.Equal(data[:4], indexMagic) || (len(data) - indexHeaderSize) % indexEntrySize != 0 {
+                return nil, ErrorInvalidIndex
+        }
+
+        entries := make([]IndexEntry, 0, (len(data) - indexHeaderSize) / indexEntrySize)
+        for data = data[indexHeaderSize:]; len(data) > 0; data = data[indexEntrySize:] {
+                entries = append(entries, IndexEntry{
+                        Offset:         offset + int(binary.LittleEndian.Uint32(data[:4])),
+                        Position:       int(binary.LittleEndian.Uint32(data[4:8])),
+                })
+        }
+
+        return entries, nil
+}
+
+// TimeIndexEntries reads the time index of the segment at offset, a torn trailing entry is left out.
+func TimeIndexEntries(dir string, offset int) ([]TimeIndexEntry, error) {
+        data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%020d", offset) + TimeIndexExt))
+        if err != nil {
+                return nil, err
+        }
+
+        entries := make([]TimeIndexEntry, 0, len(data) / timeIndexRecordSize)
+        for ; len(data) >= timeIndexRecordSize; data = data[timeIndexRecordSize:] {
+                entries = append(entries, TimeIndexEntry{
+                        Time:           time.Unix(int64(binary.LittleEndian.Uint32(data[:4])), 0),
+                        Offset:         offset + int(binary.LittleEndian.Uint64(data[4:12])),
+                })
+        }
+
+        return entries, nil
+}
+
+// inspectSegment opens the log file of a segment read only, its index files are left alone.
+func inspectSegment(dir string, offset int, options *Options) (*segment, error) {
+        if options == nil {
+                options = &Options{}
+        }
+
+        path := filepath.Join(dir, fmt.Sprintf("%020d", offset) + SegExt)
+        f, err := os.Open(path)
+        if err != nil {
+                return nil, err
+        }
+
+        seg := &segment{
+                path:           path,
+                options:        options,
+                f:              f,
+                baseOffset:     offset,
+                keyID:          -1,
+                readOnly:       true,
+        }
+
+        if err := seg.readHeader(); err != nil {
+                f.Close()
+                return nil, err
+        }
+
+        fi, err := f.Stat()
+        if err != nil {
+                f.Close()
+                return nil, err
+        }
+        seg.position = int(fi.Size())
+
+        return seg, nil
+}
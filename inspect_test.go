@@ -0,0 +1,112 @@
+package commitlog
+
+import (
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+func TestSegments(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 5; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Sync()
+
+        infos, err := Segments("test.db", nil)
+        if err != nil || len(infos) != 3 {
+                t.Fatalf("Expect 3 segments but got: %v, %v", len(infos), err)
+        }
+        if info := infos[1]; info.BaseOffset != 2 || info.Records != 2 || info.FirstOffset != 2 || info.LastOffset != 3 || info.Version != currentFormat || info.KeyID != -1 || info.FirstTime.IsZero() {
+                t.Errorf("Expect the second segment to hold offsets 2 and 3 but got: %+v", info)
+        }
+
+        path := filepath.Join("test.db", "00000000000000000004.log")
+        f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+        f.Write([]byte(`torn`))
+        f.Close()
+
+        infos, _ = Segments("test.db", nil)
+        if infos[2].TornBytes != 4 || infos[2].Records != 1 {
+                t.Errorf("Expect 4 torn bytes but got: %+v", infos[2])
+        }
+        if fi, _ := os.Stat(path); fi.Size() != int64(infos[2].Size) {
+                t.Errorf("Expect the torn tail to be left in place")
+        }
+}
+
+func TestScanDir(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 200, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Codec: GzipCodec, IndexIntervalBytes: 1})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendBatch([][]byte{[]byte(`a`), []byte(`b`), []byte(`c`)})
+        for i := 0; i < 6; i++ {
+                cl.Append([]byte(`0123456789012345678901234567890123456789`))
+        }
+        cl.AppendRecord(&Record{Key: []byte(`k`), Value: []byte(`z`)})
+        cl.Sync()
+
+        offsets := make([]int, 0)
+        next, err := ScanDir("test.db", 1, nil, func(rec *Record) bool {
+                offsets = append(offsets, rec.Offset)
+                return true
+        })
+        if err != nil || next != 10 || len(offsets) != 9 || offsets[0] != 1 || offsets[8] != 9 {
+                t.Errorf("Expect offsets 1 to 9 but got: %v, %v, %v", offsets, next, err)
+        }
+
+        var last *Record
+        if next, err := ScanDir("test.db", 9, nil, func(rec *Record) bool { last = rec; return false }); err != nil || next != 10 || string(last.Key) != `k` {
+                t.Errorf("Expect the keyed record but got: %+v, %v, %v", last, next, err)
+        }
+
+        if next, _ := ScanDir("test.db", 10, nil, func(rec *Record) bool { return true }); next != 10 {
+                t.Errorf("Expect no records after the end but got next: %v", next)
+        }
+
+        entries, err := IndexEntries("test.db", 0)
+        if err != nil || len(entries) == 0 || entries[0].Offset != 0 || entries[0].Position != segmentHeaderSize {
+                t.Errorf("Expect the first batch to be indexed at the start of the segment but got: %+v, %v", entries, err)
+        }
+
+        timeEntries, err := TimeIndexEntries("test.db", 0)
+        if err != nil || len(timeEntries) == 0 || timeEntries[0].Time.IsZero() {
+                t.Errorf("Expect time index entries but got: %+v, %v", timeEntries, err)
+        }
+}
+
+func TestScanDirEncrypted(t *testing.T) {
+        keys := newTestKeys()
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, Encryption: &Encryption{Keys: keys}})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`secret`))
+        cl.Sync()
+
+        infos, err := Segments("test.db", nil)
+        if err != nil || infos[0].KeyID < 0 || infos[0].Records != 1 {
+                t.Errorf("Expect an encrypted segment to be listed without its key but got: %+v, %v", infos, err)
+        }
+
+        if _, err := ScanDir("test.db", 0, nil, func(rec *Record) bool { return true }); err != ErrorNoEncryption {
+                t.Errorf("Expect ErrorNoEncryption but got: %v", err)
+        }
+
+        var value string
+        options := &Options{Encryption: &Encryption{Keys: keys}}
+        if _, err := ScanDir("test.db", 0, options, func(rec *Record) bool { value = string(rec.Value); return true }); err != nil || value != `secret` {
+                t.Errorf("Expect secret but got: %v, %v", value, err)
+        }
+}
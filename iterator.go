@@ -0,0 +1,264 @@
+package commitlog
+
+import (
+        "bufio"
+        "io"
+        "sync/atomic"
+)
+
+const (
+        iteratorBufferSize = 64 * 1024
+)
+
+// Iterator reads records sequentially from an offset onwards and moves across segments on its own.
+//
+//      it := cl.NewIterator(offset)
+//      defer it.Close()
+//      for it.Next() {
+//              rec := it.Record()
+//      }
+//      if err := it.Err(); err != nil {
+//      }
+//
+// Next returns false once the end of the log is reached, it can be called again later on to pick up new records.
+// When retention removes the segment being read the iterator moves on to the oldest segment left, after a
+// truncation it goes on from the offset it stopped at.
+type Iterator struct {
+        cl              *CommitLog
+        seg             *segment
+        generation      uint32  // of seg when the iterator opened it
+        r               *bufio.Reader
+        from            int     // first offset to return
+        offset          int     // offset of the next record in seg, for formats which do not store it
+        position        int     // byte position of the next record in seg
+        end             int     // byte position up to which r reads
+        rec             *Record
+        batch           []*Record // records of a compressed batch yet to be returned
+        err             error
+        closed          bool
+}
+
+func (cl *CommitLog) NewIterator(offset int) *Iterator {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        it := &Iterator{
+                cl:             cl,
+                from:           offset,
+        }
+        it.seek(offset)
+
+        return it
+}
+
+// seek moves the iterator to the segment holding offset, or to the oldest one when offset is no longer there.
+// Callers hold cl.mu.
+func (it *Iterator) seek(offset int) {
+        seg := it.cl.segments[0]
+        for _, s := range it.cl.segments {
+                if s.baseOffset <= offset {
+                        seg = s
+                }
+        }
+
+        if it.open(seg); it.err != nil {
+                return
+        }
+
+        // start from the closest index entry when the index is at hand
+        if entry, ok := seg.index.lookup(offset - seg.baseOffset); seg.isLoaded && ok {
+                it.offset = seg.baseOffset + entry.offset
+                it.position = entry.position
+                it.end = entry.position
+        }
+}
+
+// open moves the iterator to seg, which is kept open until the iterator leaves it. Callers hold cl.mu.
+func (it *Iterator) open(seg *segment) {
+        it.leave()
+
+        if err := it.cl.acquire(seg); err != nil {
+                it.err = err
+                return
+        }
+        seg.refs++
+
+        it.seg = seg
+        it.generation = atomic.LoadUint32(&seg.generation)
+        it.r = nil
+        it.batch = nil
+        it.offset = seg.baseOffset
+        it.position = seg.headerSize()
+        it.end = it.position
+}
+
+func (it *Iterator) Next() bool {
+        if it.err != nil || it.closed {
+                return false
+        }
+
+        for {
+                rec, err := it.readRecord()
+                if err == io.EOF {
+                        if !it.nextSegment() {
+                                return false
+                        }
+                        continue
+                }
+                if err != nil {
+                        // reads of a segment which is being truncated or removed fail
+                        if it.moved() {
+                                if it.err != nil {
+                                        return false
+                                }
+                                continue
+                        }
+                        it.err = err
+                        return false
+                }
+
+                if rec.Offset >= it.from {
+                        it.rec = rec
+                        return true
+                }
+        }
+}
+
+// Record returns the record read by the last call to Next.
+func (it *Iterator) Record() *Record {
+        return it.rec
+}
+
+func (it *Iterator) Err() error {
+        return it.err
+}
+
+func (it *Iterator) Close() error {
+        it.cl.mu.Lock()
+        defer it.cl.mu.Unlock()
+
+        it.closed = true
+        it.r = nil
+        it.batch = nil
+        it.leave()
+
+        return nil
+}
+
+// moved seeks the next offset again when the segment was truncated or removed since the iterator opened it.
+// The records up to that offset were returned already and are not returned again.
+func (it *Iterator) moved() bool {
+        if atomic.LoadUint32(&it.seg.generation) == it.generation {
+                return false
+        }
+
+        it.cl.mu.Lock()
+        defer it.cl.mu.Unlock()
+
+        if it.offset > it.from {
+                it.from = it.offset
+        }
+        it.seek(it.from)
+
+        return true
+}
+
+func (it *Iterator) leave() {
+        if it.seg != nil {
+                it.seg.unref()
+                it.seg = nil
+        }
+}
+
+// readRecord returns io.EOF when there is nothing left to read in the current segment.
+func (it *Iterator) readRecord() (*Record, error) {
+        if len(it.batch) > 0 {
+                rec := it.batch[0]
+                it.batch = it.batch[1:]
+                return rec, nil
+        }
+
+        if it.moved() && it.err != nil {
+                return nil, it.err
+        }
+
+        if it.position == it.end {
+                if err := it.refill(); err != nil {
+                        return nil, err
+                }
+        }
+
+        header := make([]byte, it.seg.recordHeaderSize())
+        if _, err := io.ReadFull(it.r, header); err != nil {
+                return nil, it.corrupted(err)
+        }
+
+        record := make([]byte, len(header) + it.seg.recordSize(header))
+        copy(record, header)
+        if _, err := io.ReadFull(it.r, record[len(header):]); err != nil {
+                return nil, it.corrupted(err)
+        }
+
+        rec, ok := it.seg.decodeSegmentRecord(record, it.offset)
+        if !ok {
+                return nil, it.corrupted(io.ErrUnexpectedEOF)
+        }
+
+        recs, ok, err := it.seg.expand(rec)
+        if err != nil {
+                return nil, err
+        }
+        if !ok {
+                return nil, it.corrupted(io.ErrUnexpectedEOF)
+        }
+
+        it.position += len(record)
+        it.offset = recs[len(recs)-1].Offset + 1
+        it.batch = recs[1:]
+
+        return recs[0], nil
+}
+
+// refill points the reader at the records written to the current segment since the last refill.
+func (it *Iterator) refill() error {
+        it.cl.mu.Lock()
+        f := it.seg.f
+        end, err := it.seg.size()
+        it.cl.mu.Unlock()
+
+        if err != nil {
+                return err
+        }
+        if it.position >= end {
+                return io.EOF
+        }
+
+        it.end = end
+        it.r = bufio.NewReaderSize(io.NewSectionReader(f, int64(it.position), int64(end - it.position)), iteratorBufferSize)
+
+        return nil
+}
+
+// nextSegment moves on to the segment following the current one, if there is any yet.
+func (it *Iterator) nextSegment() bool {
+        it.cl.mu.Lock()
+        defer it.cl.mu.Unlock()
+
+        for _, seg := range it.cl.segments {
+                if seg.baseOffset > it.seg.baseOffset {
+                        it.open(seg)
+                        return it.err == nil
+                }
+        }
+
+        return false
+}
+
+// Records never end in the middle of a segment, a short read means the segment is corrupted.
+func (it *Iterator) corrupted(err error) error {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return &CorruptRecordError{Segment: it.seg.path, Offset: it.offset}
+        }
+
+        return err
+}
@@ -0,0 +1,140 @@
+package commitlog
+
+import (
+        "fmt"
+        "testing"
+        "time"
+)
+
+func TestIterator(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(fmt.Sprintf("record-%03d", i)))
+        }
+
+        it := cl.NewIterator(3)
+        defer it.Close()
+
+        expect := 3
+        for it.Next() {
+                rec := it.Record()
+                if rec.Offset != expect || string(rec.Value) != fmt.Sprintf("record-%03d", expect) {
+                        t.Errorf("Expect record %v, but got: %v %s", expect, rec.Offset, rec.Value)
+                }
+                expect++
+        }
+        if err := it.Err(); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        if expect != 7 {
+                t.Errorf("Expect to iterate up to offset 6, but stopped at: %v", expect - 1)
+        }
+
+        // picks up records appended after reaching the end
+        cl.Append([]byte(`record-007`))
+        if !it.Next() || it.Record().Offset != 7 {
+                t.Errorf("Expect to read the new record 7")
+        }
+}
+
+func TestIteratorRetention(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: -1, RetentionRecords: 2}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(fmt.Sprintf("record-%03d", i)))
+        }
+
+        it := cl.NewIterator(0)
+        defer it.Close()
+
+        if !it.Next() || it.Record().Offset != 0 {
+                t.Errorf("Expect to read record 0")
+        }
+
+        // the segment being read goes away, the iterator goes on with the oldest segment left
+        cl.Compact()
+
+        if !it.Next() || it.Record().Offset != 6 {
+                t.Errorf("Expect to read record 6 but got: %+v, %v", it.Record(), it.Err())
+        }
+        if it.Next() || it.Err() != nil {
+                t.Errorf("Expect the end of the log but got: %v", it.Err())
+        }
+}
+
+func TestIteratorTruncate(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(fmt.Sprintf("record-%03d", i)))
+        }
+
+        it := cl.NewIterator(0)
+        defer it.Close()
+
+        for i := 0; i < 5; i++ {
+                it.Next()
+        }
+
+        if err := cl.Truncate(2); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        for i := 2; i < 7; i++ {
+                cl.Append([]byte(fmt.Sprintf("new-%03d", i)))
+        }
+
+        // records up to offset 4 were returned before the truncation
+        if !it.Next() || it.Record().Offset != 5 || string(it.Record().Value) != `new-005` {
+                t.Errorf("Expect to read the new record 5 but got: %+v, %v", it.Record(), it.Err())
+        }
+}
+
+func TestIteratorFromStart(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendBatch([][]byte{[]byte(`123`), []byte(`456`), []byte(`789`)})
+
+        it := cl.NewIterator(0)
+        count := 0
+        for it.Next() {
+                count++
+        }
+        it.Close()
+
+        if count != 3 {
+                t.Errorf("Expect 3 records but got: %v", count)
+        }
+}
+
+func BenchmarkIterator(b *testing.B) {
+        cl, _ := New("test.db", nil)
+        data := make([]byte, 256)
+        for i := 0; i < b.N; i++ {
+                cl.Append(data)
+        }
+
+        b.ResetTimer()
+        it := cl.NewIterator(0)
+        for it.Next() {
+        }
+        it.Close()
+
+        cleanup(cl)
+}
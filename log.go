@@ -0,0 +1,39 @@
+package commitlog
+
+import (
+        "context"
+        "time"
+)
+
+// Log is the API shared by an embedded CommitLog and the client of a remote one, see package client.
+// Code written against Log can switch between the two by configuration.
+type Log interface {
+        Append(data []byte) (int, error)
+        AppendRecord(rec *Record) (int, error)
+        AppendBatch(data [][]byte) (int, int, error)
+        AppendRecords(recs []*Record) (int, int, error)
+        Read(offset int) ([]byte, error)
+        ReadRecord(offset int) (*Record, error)
+        OffsetForTime(tm time.Time) (int, error)
+        Scan(offset int) Cursor
+        Tail(ctx context.Context, offset int) Cursor
+        Close() error
+}
+
+// Cursor reads records one after another, both Iterator and Subscription are cursors.
+type Cursor interface {
+        Next() bool
+        Record() *Record
+        Err() error
+        Close() error
+}
+
+// Scan is NewIterator returning a Cursor.
+func (cl *CommitLog) Scan(offset int) Cursor {
+        return cl.NewIterator(offset)
+}
+
+// Tail is Subscribe returning a Cursor.
+func (cl *CommitLog) Tail(ctx context.Context, offset int) Cursor {
+        return cl.Subscribe(ctx, offset)
+}
@@ -0,0 +1,56 @@
+package commitlog
+
+// acquire makes sure the files of seg are open and marks it as the most recently used segment.
+// The least recently used segments get their files closed once more than MaxOpenSegments are open,
+// except for the active segment, seg itself and segments an iterator is reading, so more may stay open
+// while they are in use. Callers hold cl.mu.
+func (cl *CommitLog) acquire(seg *segment) error {
+        if !seg.isOpen {
+                if err := seg.open(); err != nil {
+                        return err
+                }
+        }
+
+        if seg.lru == nil {
+                seg.lru = cl.lru.PushFront(seg)
+        } else {
+                cl.lru.MoveToFront(seg.lru)
+        }
+
+        return cl.evict(seg)
+}
+
+// evict closes the least recently used segments over MaxOpenSegments, except for keep.
+func (cl *CommitLog) evict(keep *segment) error {
+        e := cl.lru.Back()
+
+        for cl.lru.Len() > cl.options.MaxOpenSegments && e != nil {
+                seg := e.Value.(*segment)
+                e = e.Prev()
+
+                if seg == keep || seg == cl.curSegment || seg.refs > 0 {
+                        continue
+                }
+
+                cl.release(seg)
+                if err := seg.Close(); err != nil {
+                        return err
+                }
+        }
+
+        return nil
+}
+
+// release forgets about seg, which is closed or removed by the caller.
+func (cl *CommitLog) release(seg *segment) {
+        if seg.lru != nil {
+                cl.lru.Remove(seg.lru)
+                seg.lru = nil
+        }
+}
+
+func (cl *CommitLog) removeSegment(seg *segment) error {
+        cl.release(seg)
+
+        return seg.Remove()
+}
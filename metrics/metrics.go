@@ -0,0 +1,100 @@
+// Package metrics exports the Stats of a CommitLog in the Prometheus text format and through expvar.
+// It is kept apart from package commitlog, importing expvar registers /debug/vars on http.DefaultServeMux.
+//
+//      http.Handle("/metrics", metrics.Handler(cl))
+//      metrics.Publish("commitlog", cl)
+package metrics
+
+import (
+        "bufio"
+        "errors"
+        "expvar"
+        "fmt"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+)
+
+var (
+        ErrorPublished = errors.New("Expvar name is already published")
+)
+
+type metric struct {
+        name            string
+        kind            string // gauge or counter
+        help            string
+        value           func(stats *commitlog.Stats) float64
+}
+
+var metrics = []metric{
+        {"commitlog_segments", "gauge", "Segments of the log.", func(s *commitlog.Stats) float64 { return float64(s.Segments) }},
+        {"commitlog_open_segments", "gauge", "Segments whose files are open.", func(s *commitlog.Stats) float64 { return float64(s.OpenSegments) }},
+        {"commitlog_bytes", "gauge", "Bytes of the log files.", func(s *commitlog.Stats) float64 { return float64(s.Bytes) }},
+        {"commitlog_oldest_offset", "gauge", "Offset of the oldest record, -1 when the log is empty.", func(s *commitlog.Stats) float64 { return float64(s.OldestOffset) }},
+        {"commitlog_newest_offset", "gauge", "Offset of the newest record, -1 when the log is empty.", func(s *commitlog.Stats) float64 { return float64(s.NewestOffset) }},
+        {"commitlog_oldest_timestamp_seconds", "gauge", "Time of the oldest record.", func(s *commitlog.Stats) float64 { return seconds(s.OldestTime) }},
+        {"commitlog_newest_timestamp_seconds", "gauge", "Time of the newest record.", func(s *commitlog.Stats) float64 { return seconds(s.NewestTime) }},
+        {"commitlog_appended_records_total", "counter", "Records appended.", func(s *commitlog.Stats) float64 { return float64(s.Appends) }},
+        {"commitlog_appended_bytes_total", "counter", "Bytes written to the log files by appends.", func(s *commitlog.Stats) float64 { return float64(s.AppendedBytes) }},
+        {"commitlog_reads_total", "counter", "Reads of single records.", func(s *commitlog.Stats) float64 { return float64(s.Reads) }},
+        {"commitlog_read_seconds_total", "counter", "Time spent reading single records.", func(s *commitlog.Stats) float64 { return s.ReadTime.Seconds() }},
+        {"commitlog_compactions_total", "counter", "Runs of Compact.", func(s *commitlog.Stats) float64 { return float64(s.Compactions) }},
+        {"commitlog_compaction_errors_total", "counter", "Runs of Compact which failed.", func(s *commitlog.Stats) float64 { return float64(s.CompactionErrors) }},
+        {"commitlog_compacted_bytes_total", "counter", "Bytes of log files removed by Compact.", func(s *commitlog.Stats) float64 { return float64(s.CompactedBytes) }},
+}
+
+// Handler serves the Stats of the logs in the Prometheus text format, every sample is labeled with the path of its log.
+func Handler(logs ...*commitlog.CommitLog) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                stats := make([]*commitlog.Stats, len(logs))
+                for i, cl := range logs {
+                        s, err := cl.Stats()
+                        if err != nil {
+                                http.Error(w, err.Error(), http.StatusInternalServerError)
+                                return
+                        }
+                        stats[i] = s
+                }
+
+                w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+                bw := bufio.NewWriter(w)
+                for _, m := range metrics {
+                        fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+                        for i, cl := range logs {
+                                fmt.Fprintf(bw, "%s{path=\"%s\"} %v\n", m.name, escapeLabel(cl.Path), m.value(stats[i]))
+                        }
+                }
+                bw.Flush()
+        })
+}
+
+// Publish exports the Stats of cl as the expvar name, ErrorPublished is returned when the name is taken.
+func Publish(name string, cl *commitlog.CommitLog) error {
+        if expvar.Get(name) != nil {
+                return ErrorPublished
+        }
+
+        expvar.Publish(name, expvar.Func(func() interface{} {
+                stats, err := cl.Stats()
+                if err != nil {
+                        return err.Error()
+                }
+                return stats
+        }))
+
+        return nil
+}
+
+func seconds(tm time.Time) float64 {
+        if tm.IsZero() {
+                return 0
+        }
+
+        return float64(tm.UnixNano()) / float64(time.Second)
+}
+
+func escapeLabel(value string) string {
+        return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
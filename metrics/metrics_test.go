@@ -0,0 +1,76 @@
+package metrics
+
+import (
+        "encoding/json"
+        "expvar"
+        "fmt"
+        "io/ioutil"
+        "net/http/httptest"
+        "os"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+)
+
+func TestHandler(t *testing.T) {
+        cl, err := commitlog.New("test.db", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer func() {
+                cl.Close()
+                os.RemoveAll(cl.Path)
+        }()
+
+        cl.Append([]byte(`a`))
+        cl.Append([]byte(`b`))
+        cl.Read(0)
+
+        w := httptest.NewRecorder()
+        Handler(cl).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+        body, _ := ioutil.ReadAll(w.Body)
+
+        for _, line := range []string{
+                "# TYPE commitlog_appended_records_total counter",
+                `commitlog_appended_records_total{path="test.db"} 2`,
+                `commitlog_reads_total{path="test.db"} 1`,
+                `commitlog_newest_offset{path="test.db"} 1`,
+                `commitlog_segments{path="test.db"} 1`,
+        } {
+                if !strings.Contains(string(body), line + "\n") {
+                        t.Errorf("Expect %v in the metrics but got: %s", line, body)
+                }
+        }
+        if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+                t.Errorf("Expect the Prometheus text format but got: %v", ct)
+        }
+}
+
+func TestPublish(t *testing.T) {
+        cl, err := commitlog.New("test.db", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer func() {
+                cl.Close()
+                os.RemoveAll(cl.Path)
+        }()
+
+        cl.Append([]byte(`a`))
+
+        // expvar names stay taken for the life of the process, also across runs of -count
+        name := fmt.Sprintf("test_commitlog_%d", time.Now().UnixNano())
+        if err := Publish(name, cl); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        if err := Publish(name, cl); err != ErrorPublished {
+                t.Errorf("Expect ErrorPublished but got: %v", err)
+        }
+
+        var stats commitlog.Stats
+        if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil || stats.Appends != 1 || stats.NewestOffset != 0 {
+                t.Errorf("Expect the stats to be published but got: %+v, %v", stats, err)
+        }
+}
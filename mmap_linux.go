@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package commitlog
+
+import (
+        "os"
+        "syscall"
+)
+
+// mmapFile maps the first size bytes of f read-only, the pages are shared with the page cache.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+        if size == 0 {
+                return []byte{}, nil
+        }
+
+        return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+        if len(data) == 0 {
+                return nil
+        }
+
+        return syscall.Munmap(data)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package commitlog
+
+import (
+        "os"
+)
+
+// mmapFile falls back to reading the first size bytes of f on platforms without mmap support.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+        data := make([]byte, size)
+
+        if _, err := f.ReadAt(data, 0); err != nil {
+                return nil, err
+        }
+
+        return data, nil
+}
+
+func munmapFile(data []byte) error {
+        return nil
+}
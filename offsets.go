@@ -0,0 +1,167 @@
+package commitlog
+
+import (
+        "encoding/binary"
+        "errors"
+        "path/filepath"
+        "sort"
+        "sync"
+)
+
+const (
+        // the consumer offsets log lives in a directory of its own next to the segments
+        offsetsDir = "__consumer_offsets"
+
+        offsetsMaxSegmentSize = 1024 * 1024
+)
+
+var (
+        ErrorGroupNotFound = errors.New("Consumer group not found")
+)
+
+// offsetStore keeps the offset committed by every consumer group in a key compacted log,
+// the group being the key and the offset the value. It is opened on first use.
+type offsetStore struct {
+        mu              sync.Mutex
+        log             *CommitLog
+        committed       map[string]int
+}
+
+func openOffsetStore(dir string, options *Options) (*offsetStore, error) {
+        log, err := New(dir, &Options{
+                MaxSegmentSize:         offsetsMaxSegmentSize,
+                CompactionInterval:     options.CompactionInterval,
+                RetentionPolicy:        -1,
+                KeyCompaction:          true,
+                SyncPolicy:             SyncEveryAppend,
+        })
+        if err != nil {
+                return nil, err
+        }
+
+        store := &offsetStore{
+                log:            log,
+                committed:      make(map[string]int),
+        }
+
+        it := log.NewIterator(0)
+        defer it.Close()
+        for it.Next() {
+                rec := it.Record()
+                if len(rec.Value) == 8 {
+                        store.committed[string(rec.Key)] = int(int64(binary.LittleEndian.Uint64(rec.Value)))
+                }
+        }
+        if err := it.Err(); err != nil {
+                log.Close()
+                return nil, err
+        }
+
+        return store, nil
+}
+
+func (cl *CommitLog) offsetStore() (*offsetStore, error) {
+        cl.offsetsMu.Lock()
+        defer cl.offsetsMu.Unlock()
+
+        select {
+        case <- cl.closed:
+                return nil, ErrorClosed
+        default:
+        }
+
+        if cl.offsets == nil {
+                store, err := openOffsetStore(filepath.Join(cl.Path, offsetsDir), cl.options)
+                if err != nil {
+                        return nil, err
+                }
+                cl.offsets = store
+        }
+
+        return cl.offsets, nil
+}
+
+func (cl *CommitLog) closeOffsetStore() error {
+        cl.offsetsMu.Lock()
+        defer cl.offsetsMu.Unlock()
+
+        if cl.offsets == nil {
+                return nil
+        }
+
+        return cl.offsets.log.Close()
+}
+
+// CommitOffset records offset as the last offset group has processed. It is on disk once CommitOffset returns.
+func (cl *CommitLog) CommitOffset(group string, offset int) error {
+        store, err := cl.offsetStore()
+        if err != nil {
+                return err
+        }
+
+        store.mu.Lock()
+        defer store.mu.Unlock()
+
+        value := make([]byte, 8)
+        binary.LittleEndian.PutUint64(value, uint64(offset))
+
+        if _, err := store.log.AppendRecord(&Record{Key: []byte(group), Value: value}); err != nil {
+                return err
+        }
+        store.committed[group] = offset
+
+        return nil
+}
+
+// FetchOffset returns the last offset committed by group.
+func (cl *CommitLog) FetchOffset(group string) (int, error) {
+        store, err := cl.offsetStore()
+        if err != nil {
+                return 0, err
+        }
+
+        store.mu.Lock()
+        defer store.mu.Unlock()
+
+        offset, ok := store.committed[group]
+        if !ok {
+                return 0, ErrorGroupNotFound
+        }
+
+        return offset, nil
+}
+
+// ListGroups returns the groups which committed an offset, in name order.
+func (cl *CommitLog) ListGroups() ([]string, error) {
+        store, err := cl.offsetStore()
+        if err != nil {
+                return nil, err
+        }
+
+        store.mu.Lock()
+        defer store.mu.Unlock()
+
+        groups := make([]string, 0, len(store.committed))
+        for group := range store.committed {
+                groups = append(groups, group)
+        }
+        sort.Strings(groups)
+
+        return groups, nil
+}
+
+// Lag returns how many offsets group is behind the last offset of the log.
+func (cl *CommitLog) Lag(group string) (int, error) {
+        committed, err := cl.FetchOffset(group)
+        if err != nil {
+                return 0, err
+        }
+
+        last := cl.Offset()
+
+        if committed >= last {
+                return 0, nil
+        }
+
+        return last - committed, nil
+}
@@ -0,0 +1,76 @@
+package commitlog
+
+import (
+        "io/ioutil"
+        "testing"
+        "time"
+)
+
+func TestConsumerOffsets(t *testing.T) {
+        options := &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 10; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+
+        if _, err := cl.FetchOffset("billing"); err != ErrorGroupNotFound {
+                t.Errorf("Expect ErrorGroupNotFound but got: %v", err)
+        }
+
+        cl.CommitOffset("billing", 3)
+        cl.CommitOffset("search", 9)
+        cl.CommitOffset("billing", 5)
+
+        if offset, err := cl.FetchOffset("billing"); err != nil || offset != 5 {
+                t.Errorf("Expect offset 5 but got: %v, %v", offset, err)
+        }
+
+        if groups, err := cl.ListGroups(); err != nil || len(groups) != 2 || groups[0] != "billing" || groups[1] != "search" {
+                t.Errorf("Expect groups billing and search but got: %v, %v", groups, err)
+        }
+
+        if lag, err := cl.Lag("billing"); err != nil || lag != 4 {
+                t.Errorf("Expect lag 4 but got: %v, %v", lag, err)
+        }
+        if lag, err := cl.Lag("search"); err != nil || lag != 0 {
+                t.Errorf("Expect lag 0 but got: %v, %v", lag, err)
+        }
+
+        cl.Close()
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        if offset, err := cl.FetchOffset("billing"); err != nil || offset != 5 {
+                t.Errorf("Expect offset 5 after reopening but got: %v, %v", offset, err)
+        }
+        if cl.Offset() != 9 {
+                t.Errorf("Expect the offsets log to stay out of the segments but got offset: %v", cl.Offset())
+        }
+}
+
+func TestConsumerOffsetsOpenedOnFirstUse(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        files, _ := ioutil.ReadDir("test.db")
+        for _, file := range files {
+                if file.Name() == offsetsDir {
+                        t.Errorf("Expect no consumer offsets log before an offset is committed")
+                }
+        }
+
+        cl.Close()
+        if err := cl.CommitOffset("billing", 1); err != ErrorClosed {
+                t.Errorf("Expect ErrorClosed but got: %v", err)
+        }
+}
@@ -0,0 +1,202 @@
+package commitlog
+
+import (
+        "encoding/binary"
+        "hash/crc32"
+        "time"
+)
+
+// Record is a single entry of the log.
+// Records stored in v1 and v2 segments only carry a value.
+type Record struct {
+        Offset          int
+        Timestamp       time.Time // millisecond precision, set to the time of writing when zero
+        Key             []byte
+        Headers         []Header
+        Value           []byte
+        attributes      byte
+        codec           byte // id of the codec of the batch the record was read from
+}
+
+type Header struct {
+        Key             string
+        Value           string
+}
+
+const (
+        recordV3HeaderSize = 8 // size and checksum
+
+        // Record attributes
+        attrBatchContinued byte = 1 << 0 // more records of the same batch follow
+        attrCompressed     byte = 1 << 1 // the value is a compressed batch, see compressBatch
+        attrEncrypted      byte = 1 << 2 // the value is encrypted with the key of the segment, see encryptValue
+)
+
+// Record format v3, all integers little endian, lengths of nil key and value are -1
+// + ----------------------------------------------------------- +
+// | Size (4B), bytes after the checksum                         |
+// | CRC32C (4B), over the bytes after the checksum              |
+// | Attributes (1B)                                             |
+// | Offset Delta (4B), offset relative to the segment           |
+// | Timestamp (8B), milliseconds since epoch                    |
+// | Key Length (varint) | Key                                   |
+// | Header Count (uvarint)                                      |
+// | Header Key Length (uvarint) | Key | Value Length | Value    |
+// | ...                                                         |
+// | Value Length (varint) | Value                               |
+// + ----------------------------------------------------------- +
+func encodeRecordV3(rec *Record, offsetDelta int) []byte {
+        buf := make([]byte, recordV3HeaderSize + 13, recordV3Size(rec))
+
+        buf[recordV3HeaderSize] = rec.attributes
+        binary.LittleEndian.PutUint32(buf[recordV3HeaderSize+1:], uint32(offsetDelta))
+        binary.LittleEndian.PutUint64(buf[recordV3HeaderSize+5:], uint64(toMillis(rec.Timestamp)))
+
+        buf = appendBytes(buf, rec.Key)
+        buf = appendUvarint(buf, uint64(len(rec.Headers)))
+        for _, h := range rec.Headers {
+                buf = appendUvarint(buf, uint64(len(h.Key)))
+                buf = append(buf, h.Key...)
+                buf = appendUvarint(buf, uint64(len(h.Value)))
+                buf = append(buf, h.Value...)
+        }
+        buf = appendBytes(buf, rec.Value)
+
+        binary.LittleEndian.PutUint32(buf[:4], uint32(len(buf) - recordV3HeaderSize))
+        binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(buf[recordV3HeaderSize:], crcTable))
+
+        return buf
+}
+
+func recordV3Size(rec *Record) int {
+        size := recordV3HeaderSize + 13 + bytesSize(rec.Key) + uvarintSize(uint64(len(rec.Headers))) + bytesSize(rec.Value)
+
+        for _, h := range rec.Headers {
+                size += uvarintSize(uint64(len(h.Key))) + len(h.Key) + uvarintSize(uint64(len(h.Value))) + len(h.Value)
+        }
+
+        return size
+}
+
+// decodeRecordV3 parses a whole record, ok is false when it is torn or corrupted.
+func decodeRecordV3(record []byte, baseOffset int) (rec *Record, ok bool) {
+        if len(record) < recordV3HeaderSize + 13 {
+                return nil, false
+        }
+        if int(binary.LittleEndian.Uint32(record[:4])) != len(record) - recordV3HeaderSize {
+                return nil, false
+        }
+        if binary.LittleEndian.Uint32(record[4:8]) != crc32.Checksum(record[recordV3HeaderSize:], crcTable) {
+                return nil, false
+        }
+
+        d := &recordDecoder{buf: record[recordV3HeaderSize+13:], ok: true}
+        rec = &Record{
+                Offset:         baseOffset + int(binary.LittleEndian.Uint32(record[recordV3HeaderSize+1:])),
+                Timestamp:      fromMillis(int64(binary.LittleEndian.Uint64(record[recordV3HeaderSize+5:]))),
+                Key:            d.bytes(),
+                attributes:     record[recordV3HeaderSize],
+        }
+
+        if n := d.uvarint(); n > 0 && n <= uint64(len(d.buf)) {
+                rec.Headers = make([]Header, n)
+                for i := range rec.Headers {
+                        rec.Headers[i].Key = string(d.next(int(d.uvarint())))
+                        rec.Headers[i].Value = string(d.next(int(d.uvarint())))
+                }
+        } else if n != 0 {
+                return nil, false
+        }
+
+        rec.Value = d.bytes()
+
+        return rec, d.ok && len(d.buf) == 0
+}
+
+type recordDecoder struct {
+        buf             []byte
+        ok              bool
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+        v, n := binary.Uvarint(d.buf)
+        if n <= 0 {
+                d.ok = false
+                return 0
+        }
+        d.buf = d.buf[n:]
+
+        return v
+}
+
+func (d *recordDecoder) next(n int) []byte {
+        if n < 0 || n > len(d.buf) {
+                d.ok = false
+                return nil
+        }
+        data := d.buf[:n]
+        d.buf = d.buf[n:]
+
+        return data
+}
+
+// bytes reads a varint length prefixed byte slice, -1 stands for nil
+func (d *recordDecoder) bytes() []byte {
+        n, o := binary.Varint(d.buf)
+        if o <= 0 {
+                d.ok = false
+                return nil
+        }
+        d.buf = d.buf[o:]
+
+        if n < 0 {
+                return nil
+        }
+
+        return append([]byte{}, d.next(int(n))...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+        tmp := make([]byte, binary.MaxVarintLen64)
+        n := binary.PutUvarint(tmp, v)
+
+        return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+        tmp := make([]byte, binary.MaxVarintLen64)
+
+        if data == nil {
+                n := binary.PutVarint(tmp, -1)
+                return append(buf, tmp[:n]...)
+        }
+
+        n := binary.PutVarint(tmp, int64(len(data)))
+        buf = append(buf, tmp[:n]...)
+
+        return append(buf, data...)
+}
+
+func uvarintSize(v uint64) int {
+        tmp := make([]byte, binary.MaxVarintLen64)
+
+        return binary.PutUvarint(tmp, v)
+}
+
+func bytesSize(data []byte) int {
+        tmp := make([]byte, binary.MaxVarintLen64)
+
+        if data == nil {
+                return binary.PutVarint(tmp, -1)
+        }
+
+        return binary.PutVarint(tmp, int64(len(data))) + len(data)
+}
+
+func toMillis(tm time.Time) int64 {
+        return tm.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+        return time.Unix(ms / 1000, (ms % 1000) * int64(time.Millisecond))
+}
@@ -0,0 +1,509 @@
+package commitlog
+
+import (
+        "bufio"
+        "context"
+        "encoding/binary"
+        "errors"
+        "hash/crc32"
+        "io"
+        "net"
+        "sync"
+        "time"
+)
+
+var (
+        ErrorAckTimeout = errors.New("Timed out waiting for followers")
+        ErrorReplicationProtocol = errors.New("Unexpected replication message")
+)
+
+const (
+        // Replication messages, framed as | Type (1B) | Length (4B) | Payload |
+        msgFetch        byte = 1 // follower: | Next Offset (8B) | Offset (8B) | Checksum (4B) | ... |, see fetchOffsets
+        msgTruncate     byte = 2 // leader: | Offset (8B) |, the follower diverged from there on
+        msgRecords      byte = 3 // leader: | Offset (8B) | v3 record | ... |
+        msgAck          byte = 4 // follower: | Next Offset (8B) |
+
+        replicationBatchSize    = 1000
+        replicationBatchBytes   = 4 * 1024 * 1024 // a batch goes over it by at most one record
+        followRetryInterval     = 100 * time.Millisecond
+        fetchChecksums          = 16 // records right before the next offset of a follower compared with the leader
+)
+
+// replicas keeps the next offset of every follower connected to a leader.
+type replicas struct {
+        mu              sync.Mutex
+        next            map[net.Conn]int
+        changed         chan struct{} // closed and replaced on every ack
+}
+
+func newReplicas() *replicas {
+        return &replicas{
+                next:           make(map[net.Conn]int),
+                changed:        make(chan struct{}),
+        }
+}
+
+func (r *replicas) ack(conn net.Conn, next int) {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+
+        r.next[conn] = next
+        close(r.changed)
+        r.changed = make(chan struct{})
+}
+
+func (r *replicas) remove(conn net.Conn) {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+
+        delete(r.next, conn)
+}
+
+// caughtUp returns how many followers reached next, together with a channel closed by the next ack.
+func (r *replicas) caughtUp(next int) (int, <-chan struct{}) {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+
+        n := 0
+        for _, followerNext := range r.next {
+                if followerNext >= next {
+                        n++
+                }
+        }
+
+        return n, r.changed
+}
+
+// waitAcks blocks until Options.ReplicationAcks followers have the records up to last.
+func (cl *CommitLog) waitAcks(last int) error {
+        if cl.options.ReplicationAcks <= 0 {
+                return nil
+        }
+
+        timeout := time.NewTimer(cl.options.AckTimeout)
+        defer timeout.Stop()
+
+        for {
+                n, changed := cl.replicas.caughtUp(last + 1)
+                if n >= cl.options.ReplicationAcks {
+                        return nil
+                }
+
+                select {
+                case <- changed:
+                case <- timeout.C:
+                        return ErrorAckTimeout
+                case <- cl.closed:
+                        return ErrorClosed
+                }
+        }
+}
+
+// ServeReplication makes cl the leader of the followers connecting to l. It returns once l fails or the log is closed.
+func (cl *CommitLog) ServeReplication(l net.Listener) error {
+        done := make(chan struct{})
+        defer close(done)
+
+        go func() {
+                select {
+                case <- cl.closed:
+                        l.Close()
+                case <- done:
+                }
+        }()
+
+        for {
+                conn, err := l.Accept()
+                if err != nil {
+                        select {
+                        case <- cl.closed:
+                                return ErrorClosed
+                        default:
+                                return err
+                        }
+                }
+
+                go cl.serveFollower(conn)
+        }
+}
+
+func (cl *CommitLog) serveFollower(conn net.Conn) {
+        defer conn.Close()
+        defer cl.replicas.remove(conn)
+
+        r := bufio.NewReader(conn)
+
+        // agree on the offset to replicate from, truncating the follower until its records match
+        next := 0
+        for {
+                typ, payload, err := readMessage(r, cl.maxMessageSize())
+                if err != nil || typ != msgFetch || len(payload) < 8 || (len(payload) - 8) % 12 != 0 {
+                        return
+                }
+
+                next = int(binary.LittleEndian.Uint64(payload[:8]))
+                checksums := make(map[int]uint32)
+                for p := payload[8:]; len(p) > 0; p = p[12:] {
+                        checksums[int(binary.LittleEndian.Uint64(p[:8]))] = binary.LittleEndian.Uint32(p[8:12])
+                }
+
+                diverged, ok, err := cl.divergence(next, checksums)
+                if err != nil {
+                        return
+                }
+                if ok {
+                        break
+                }
+
+                if err := writeMessage(conn, msgTruncate, encodeOffset(diverged)); err != nil {
+                        return
+                }
+        }
+        cl.replicas.ack(conn, next)
+
+        // acks come in on their own while records are streamed out
+        broken := make(chan struct{})
+        go func() {
+                defer close(broken)
+                for {
+                        typ, payload, err := readMessage(r, cl.maxMessageSize())
+                        if err != nil || typ != msgAck || len(payload) != 8 {
+                                return
+                        }
+                        cl.replicas.ack(conn, int(binary.LittleEndian.Uint64(payload)))
+                }
+        }()
+
+        it := cl.NewIterator(next)
+        defer it.Close()
+
+        for {
+                // taken before reading, so that an append in between is not missed
+                appended := cl.waitAppend()
+
+                payload := make([]byte, 0)
+                for n := 0; n < replicationBatchSize && len(payload) < replicationBatchBytes && it.Next(); n++ {
+                        payload = append(payload, encodeReplicatedRecord(it.Record())...)
+                }
+                if it.Err() != nil {
+                        return
+                }
+
+                if len(payload) > 0 {
+                        if err := writeMessage(conn, msgRecords, payload); err != nil {
+                                return
+                        }
+                        continue
+                }
+
+                select {
+                case <- appended:
+                case <- broken:
+                        return
+                case <- cl.closed:
+                        return
+                }
+        }
+}
+
+// divergence compares the checksums of records of a follower, by offset, with the records of the leader.
+// It returns ok when they all match or the leader cannot tell, otherwise the offset to truncate the follower to:
+// the oldest one which does not match. The follower sends the checksums before its new next offset again then.
+func (cl *CommitLog) divergence(next int, checksums map[int]uint32) (int, bool, error) {
+        cl.mu.Lock()
+        leaderNext := cl.curSegment.NextOffset()
+        cl.mu.Unlock()
+
+        if next > leaderNext {
+                return leaderNext, false, nil
+        }
+
+        diverged := next
+        for offset, checksum := range checksums {
+                if offset < 0 || offset >= next {
+                        return 0, false, ErrorReplicationProtocol
+                }
+
+                rec, err := cl.readRecord(offset)
+                // compacted away or removed by retention, there is nothing to compare with
+                if err == ErrorRecordCompacted || err == ErrorRecordNotFound || err == ErrorSegmentNotFound {
+                        continue
+                }
+                if err != nil {
+                        return 0, false, err
+                }
+
+                if recordChecksum(rec) != checksum && offset < diverged {
+                        diverged = offset
+                }
+        }
+
+        // records missing on the follower before next, which the leader has, diverge as well
+        if len(checksums) == 0 && next > 0 {
+                if _, err := cl.readRecord(next - 1); err == nil {
+                        diverged = next - 1
+                }
+        }
+
+        return diverged, diverged == next, nil
+}
+
+// Follow replicates the log of the leader at addr into cl until ctx is done or cl is closed.
+// Records get the offsets they have on the leader, and cl is truncated where it diverged from it.
+// The connection is retried when it fails, other errors like a broken protocol, corrupt records
+// or a failing write to cl are returned.
+//
+// Divergence is told apart by the checksums of the last records of cl and of records further back
+// at doubling distances, see fetchOffsets. A history which differs only between those records is not noticed.
+func (cl *CommitLog) Follow(ctx context.Context, addr string) error {
+        for {
+                if err := cl.follow(ctx, addr); err != nil && !transient(err) {
+                        select {
+                        case <- ctx.Done():
+                                return ctx.Err()
+                        case <- cl.closed:
+                                return ErrorClosed
+                        default:
+                                return err
+                        }
+                }
+
+                select {
+                case <- ctx.Done():
+                        return ctx.Err()
+                case <- cl.closed:
+                        return ErrorClosed
+                case <- time.After(followRetryInterval):
+                }
+        }
+}
+
+func (cl *CommitLog) follow(ctx context.Context, addr string) error {
+        var d net.Dialer
+        conn, err := d.DialContext(ctx, "tcp", addr)
+        if err != nil {
+                return err
+        }
+        defer conn.Close()
+
+        done := make(chan struct{})
+        defer close(done)
+        go func() {
+                select {
+                case <- ctx.Done():
+                case <- cl.closed:
+                case <- done:
+                }
+                conn.Close()
+        }()
+
+        if err := cl.sendFetch(conn); err != nil {
+                return err
+        }
+
+        r := bufio.NewReader(conn)
+        for {
+                typ, payload, err := readMessage(r, cl.maxMessageSize())
+                if err != nil {
+                        return err
+                }
+
+                switch typ {
+                case msgTruncate:
+                        if len(payload) != 8 {
+                                return ErrorReplicationProtocol
+                        }
+                        if err := cl.Truncate(int(binary.LittleEndian.Uint64(payload))); err != nil {
+                                return err
+                        }
+                        if err := cl.sendFetch(conn); err != nil {
+                                return err
+                        }
+                case msgRecords:
+                        recs, err := decodeReplicatedRecords(payload)
+                        if err != nil {
+                                return err
+                        }
+                        next, err := cl.appendReplicated(recs)
+                        if err != nil {
+                                return err
+                        }
+                        if err := writeMessage(conn, msgAck, encodeOffset(next)); err != nil {
+                                return err
+                        }
+                default:
+                        return ErrorReplicationProtocol
+                }
+        }
+}
+
+// transient tells whether an error of follow comes from the connection, which is worth retrying.
+func transient(err error) bool {
+        var netErr net.Error
+
+        return errors.As(err, &netErr) || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func (cl *CommitLog) sendFetch(conn net.Conn) error {
+        cl.mu.Lock()
+        first, next := cl.segments[0].baseOffset, cl.curSegment.NextOffset()
+        cl.mu.Unlock()
+
+        payload := encodeOffset(next)
+        for _, offset := range fetchOffsets(first, next) {
+                rec, err := cl.readRecord(offset)
+                if err == ErrorRecordCompacted || err == ErrorRecordNotFound || err == ErrorSegmentNotFound {
+                        continue
+                }
+                if err != nil {
+                        return err
+                }
+
+                checksum := make([]byte, 4)
+                binary.LittleEndian.PutUint32(checksum, recordChecksum(rec))
+                payload = append(append(payload, encodeOffset(offset)...), checksum...)
+        }
+
+        return writeMessage(conn, msgFetch, payload)
+}
+
+// fetchOffsets returns the offsets whose checksums a follower sends: the fetchChecksums offsets before next,
+// then offsets at doubling distances from next down to first.
+func fetchOffsets(first int, next int) []int {
+        offsets := make([]int, 0)
+
+        for distance := 1; next - distance >= first; {
+                offsets = append(offsets, next - distance)
+                if distance < fetchChecksums {
+                        distance++
+                } else {
+                        distance *= 2
+                }
+        }
+        if len(offsets) > 0 && offsets[len(offsets)-1] != first {
+                offsets = append(offsets, first)
+        }
+
+        return offsets
+}
+
+// appendReplicated writes the records of a leader with their offsets and returns the next offset.
+// They are split up so that segments are filled the same way as by Append.
+func (cl *CommitLog) appendReplicated(recs []*Record) (int, error) {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        next := cl.curSegment.NextOffset()
+        for _, rec := range recs {
+                if rec.Offset < next {
+                        return 0, ErrorReplicationProtocol
+                }
+                next = rec.Offset + 1
+        }
+
+        for len(recs) > 0 {
+                n := 1
+                for n < len(recs) && !cl.curSegment.CheckFull(recs[:n+1]) {
+                        n++
+                }
+
+                if err := cl.writeAt(recs[:n]); err != nil {
+                        return 0, err
+                }
+                if err := cl.syncAppended(n); err != nil {
+                        return 0, err
+                }
+                recs = recs[n:]
+        }
+
+        return next, nil
+}
+
+func recordChecksum(rec *Record) uint32 {
+        return crc32.Checksum(encodeReplicatedRecord(rec), crcTable)
+}
+
+// Replicated record
+// + ----------- + ---------------------------------- +
+// | Offset (8B) | v3 record, with an offset delta of 0 |
+// + ----------- + ---------------------------------- +
+func encodeReplicatedRecord(rec *Record) []byte {
+        copied := *rec
+        copied.attributes = 0
+
+        return append(encodeOffset(rec.Offset), encodeRecordV3(&copied, 0)...)
+}
+
+func decodeReplicatedRecords(payload []byte) ([]*Record, error) {
+        recs := make([]*Record, 0)
+
+        for len(payload) > 0 {
+                if len(payload) < 8 + recordV3HeaderSize {
+                        return nil, ErrorReplicationProtocol
+                }
+                offset := int(binary.LittleEndian.Uint64(payload[:8]))
+                payload = payload[8:]
+
+                size := recordV3HeaderSize + int(binary.LittleEndian.Uint32(payload[:4]))
+                if size > len(payload) {
+                        return nil, ErrorReplicationProtocol
+                }
+
+                rec, ok := decodeRecordV3(payload[:size], 0)
+                if !ok {
+                        return nil, ErrorCorruptRecord
+                }
+                rec.Offset = offset
+
+                recs = append(recs, rec)
+                payload = payload[size:]
+        }
+
+        if len(recs) == 0 {
+                return nil, ErrorReplicationProtocol
+        }
+
+        return recs, nil
+}
+
+func encodeOffset(offset int) []byte {
+        buf := make([]byte, 8)
+        binary.LittleEndian.PutUint64(buf, uint64(offset))
+
+        return buf
+}
+
+func writeMessage(w io.Writer, typ byte, payload []byte) error {
+        buf := make([]byte, 5, 5 + len(payload))
+        buf[0] = typ
+        binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+
+        _, err := w.Write(append(buf, payload...))
+
+        return err
+}
+
+// maxMessageSize is the largest message cl accepts, a batch of records with its last record of up to MaxRecordSize.
+func (cl *CommitLog) maxMessageSize() int {
+        return replicationBatchBytes + 8 + cl.options.MaxRecordSize
+}
+
+func readMessage(r io.Reader, maxSize int) (byte, []byte, error) {
+        header := make([]byte, 5)
+        if _, err := io.ReadFull(r, header); err != nil {
+                return 0, nil, err
+        }
+
+        size := binary.LittleEndian.Uint32(header[1:])
+        if uint64(size) > uint64(maxSize) {
+                return 0, nil, ErrorReplicationProtocol
+        }
+
+        payload := make([]byte, size)
+        if _, err := io.ReadFull(r, payload); err != nil {
+                return 0, nil, err
+        }
+
+        return header[0], payload, nil
+}
@@ -0,0 +1,273 @@
+package commitlog
+
+import (
+        "bytes"
+        "context"
+        "fmt"
+        "net"
+        "os"
+        "testing"
+        "time"
+)
+
+func startLeader(t *testing.T, path string, options *Options) (*CommitLog, string) {
+        leader, err := New(path, options)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        go leader.ServeReplication(l)
+
+        return leader, l.Addr().String()
+}
+
+func startFollower(t *testing.T, ctx context.Context, path string, addr string) *CommitLog {
+        follower, err := New(path, &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        if err != nil {
+                t.Fatal(err)
+        }
+        go follower.Follow(ctx, addr)
+
+        return follower
+}
+
+// waitOffset polls until cl reaches offset
+func waitOffset(t *testing.T, cl *CommitLog, offset int) {
+        deadline := time.Now().Add(5 * time.Second)
+        for time.Now().Before(deadline) {
+                if cl.Offset() == offset {
+                        return
+                }
+                time.Sleep(10 * time.Millisecond)
+        }
+
+        t.Fatalf("Expect %v to reach offset %v", cl.Path, offset)
+}
+
+func expectSameRecords(t *testing.T, leader *CommitLog, follower *CommitLog, n int) {
+        for i := 0; i < n; i++ {
+                expected, err := leader.ReadRecord(i)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                rec, err := follower.ReadRecord(i)
+                if err != nil || !bytes.Equal(rec.Value, expected.Value) || !bytes.Equal(rec.Key, expected.Key) || !rec.Timestamp.Equal(expected.Timestamp) {
+                        t.Errorf("Expect %s at offset %v but got: %+v, %v", expected.Value, i, rec, err)
+                }
+        }
+}
+
+func cleanupReplication(logs ...*CommitLog) {
+        for _, cl := range logs {
+                cl.Close()
+                os.RemoveAll(cl.Path)
+        }
+}
+
+func TestReplication(t *testing.T) {
+        leader, addr := startLeader(t, "leader.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        ctx, cancel := context.WithCancel(context.Background())
+        follower := startFollower(t, ctx, "follower.db", addr)
+        defer cleanupReplication(leader, follower)
+        defer cancel()
+
+        for i := 0; i < 50; i++ {
+                leader.AppendRecord(&Record{Key: []byte(fmt.Sprintf("k%d", i)), Value: []byte(fmt.Sprintf("v%d", i))})
+        }
+
+        waitOffset(t, follower, 49)
+        expectSameRecords(t, leader, follower, 50)
+
+        // records appended later are streamed as well
+        leader.AppendBatch([][]byte{[]byte(`a`), []byte(`b`)})
+        waitOffset(t, follower, 51)
+        expectSameRecords(t, leader, follower, 52)
+}
+
+func TestReplicationLargeRecords(t *testing.T) {
+        leader, addr := startLeader(t, "leader.db", &Options{MaxSegmentSize: 16 * 1024 * 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        ctx, cancel := context.WithCancel(context.Background())
+        follower := startFollower(t, ctx, "follower.db", addr)
+        defer cleanupReplication(leader, follower)
+        defer cancel()
+
+        // more than fits a message of 1000 records, every record just under the default MaxRecordSize
+        value := bytes.Repeat([]byte{'v'}, 1000 * 1000)
+        for i := 0; i < 80; i++ {
+                if _, err := leader.Append(value); err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        waitOffset(t, follower, 79)
+        if data, err := follower.Read(79); err != nil || !bytes.Equal(data, value) {
+                t.Errorf("Expect the last record to be replicated but got %v bytes, %v", len(data), err)
+        }
+}
+
+func TestReplicationAcks(t *testing.T) {
+        leader, addr := startLeader(t, "leader.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1, ReplicationAcks: 2})
+        ctx, cancel := context.WithCancel(context.Background())
+        first := startFollower(t, ctx, "follower1.db", addr)
+        second := startFollower(t, ctx, "follower2.db", addr)
+        defer cleanupReplication(leader, first, second)
+        defer cancel()
+
+        for i := 0; i < 10; i++ {
+                offset, err := leader.Append([]byte(`0123456789`))
+                if err != nil {
+                        t.Fatal(err)
+                }
+
+                // both followers have the record once Append returns
+                for _, follower := range []*CommitLog{first, second} {
+                        if _, err := follower.Read(offset); err != nil {
+                                t.Errorf("Expect %v to have offset %v but got: %v", follower.Path, offset, err)
+                        }
+                }
+        }
+
+        if offset, err := leader.AppendAsync(&Record{Value: []byte(`abc`)}).Wait(); err != nil || offset != 10 {
+                t.Errorf("Expect offset 10 but got: %v, %v", offset, err)
+        }
+}
+
+func TestReplicationAckTimeout(t *testing.T) {
+        leader, err := New("leader.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1, ReplicationAcks: 1, AckTimeout: 50 * time.Millisecond})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer cleanupReplication(leader)
+
+        if _, err := leader.Append([]byte(`abc`)); err != ErrorAckTimeout {
+                t.Errorf("Expect ErrorAckTimeout but got: %v", err)
+        }
+
+        // the record is appended on the leader nevertheless
+        if data, err := leader.Read(0); err != nil || string(data) != `abc` {
+                t.Errorf("Expect abc but got: %s, %v", data, err)
+        }
+}
+
+func TestReplicationTruncatesDivergence(t *testing.T) {
+        leader, addr := startLeader(t, "leader.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        for _, value := range []string{`a`, `b`, `c`, `d`} {
+                leader.Append([]byte(value))
+        }
+
+        // a follower ahead of the leader, whose records differ from offset 2 on
+        follower, err := New("follower.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer cleanupReplication(leader, follower)
+        for i := 0; i < 2; i++ {
+                rec, _ := leader.ReadRecord(i)
+                follower.appendReplicated([]*Record{rec})
+        }
+        for _, value := range []string{`x`, `y`, `z`, `w`} {
+                follower.Append([]byte(value))
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        go follower.Follow(ctx, addr)
+
+        deadline := time.Now().Add(5 * time.Second)
+        for time.Now().Before(deadline) {
+                if data, err := follower.Read(3); err == nil && string(data) == `d` {
+                        break
+                }
+                time.Sleep(10 * time.Millisecond)
+        }
+
+        waitOffset(t, follower, 3)
+        expectSameRecords(t, leader, follower, 4)
+}
+
+func TestReplicationTruncatesEarlierDivergence(t *testing.T) {
+        leader, addr := startLeader(t, "leader.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        for _, value := range []string{`a`, `b`, `c`, `d`} {
+                leader.Append([]byte(value))
+        }
+
+        // a follower whose record 1 differs, while its last record is the one of the leader
+        follower, err := New("follower.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer cleanupReplication(leader, follower)
+        for i := 0; i < 4; i++ {
+                rec, _ := leader.ReadRecord(i)
+                if i == 1 {
+                        rec = &Record{Offset: 1, Timestamp: rec.Timestamp, Value: []byte(`x`)}
+                }
+                follower.appendReplicated([]*Record{rec})
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        go follower.Follow(ctx, addr)
+
+        deadline := time.Now().Add(5 * time.Second)
+        for time.Now().Before(deadline) {
+                if data, err := follower.Read(1); err == nil && string(data) == `b` && follower.Offset() == 3 {
+                        break
+                }
+                time.Sleep(10 * time.Millisecond)
+        }
+
+        expectSameRecords(t, leader, follower, 4)
+}
+
+func TestFetchOffsets(t *testing.T) {
+        cases := []struct {
+                first   int
+                next    int
+                offsets string
+        }{
+                {0, 0, `[]`},
+                {5, 7, `[6 5]`},
+                {0, 100, `[99 98 97 96 95 94 93 92 91 90 89 88 87 86 85 84 68 36 0]`},
+        }
+        for _, c := range cases {
+                if offsets := fmt.Sprint(fetchOffsets(c.first, c.next)); offsets != c.offsets {
+                        t.Errorf("Expect offsets %v from %v to %v, but got: %v", c.offsets, c.first, c.next, offsets)
+                }
+        }
+}
+
+func TestFollowProtocolError(t *testing.T) {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        // a leader answering the fetch with a message of an unknown type
+        go func() {
+                conn, err := l.Accept()
+                if err != nil {
+                        return
+                }
+                defer conn.Close()
+                readMessage(conn, 1024)
+                writeMessage(conn, 9, nil)
+        }()
+
+        follower, err := New("follower.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: -1})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer cleanupReplication(follower)
+
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        if err := follower.Follow(ctx, l.Addr().String()); err != ErrorReplicationProtocol {
+                t.Errorf("Expect ErrorReplicationProtocol but got: %v", err)
+        }
+}
@@ -1,25 +1,78 @@
 package commitlog
 
 import (
+        "bufio"
+        "bytes"
+        "container/list"
+        "crypto/cipher"
         "encoding/binary"
         "errors"
         "fmt"
+        "hash/crc32"
+        "io"
         "math"
         "os"
         "path/filepath"
+        "strings"
+        "sync/atomic"
         "time"
 )
 
 var (
         ErrorExceedMaxRecordSize = errors.New("Record is too big")
+        ErrorCorruptRecord = errors.New("Record is corrupted")
+        ErrorUnsupportedFormat = errors.New("Unsupported segment format")
 )
 
 const (
         SegExt           = ".log"
 
-        maxRecordSize    = math.MaxUint16
+        maxRecordSize    = math.MaxUint32 // size field of v3 records
+
+        // Segment format versions
+        // v1: no segment header, records are | Value Size (2B) | Value |
+        // v2: segment header, records are | Value Size (2B) | CRC32C (4B) | Value |
+        // v3: segment header, records carry a timestamp, key and headers, see encodeRecordV3
+        formatV1         = 1
+        formatV2         = 2
+        formatV3         = 3
+        currentFormat    = formatV3
+
+        segmentHeaderSize = 8
+
+        // Segment header flags
+        segmentEncrypted = 1 << 0 // values are encrypted with the key of the key id
+)
+
+var (
+        segmentMagic = []byte("CLOG")
+        crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
+// CorruptRecordError is returned when a record does not match its checksum.
+type CorruptRecordError struct {
+        Segment         string
+        Offset          int
+}
+
+func (e *CorruptRecordError) Error() string {
+        return fmt.Sprintf("Record %d in %s is corrupted", e.Offset, e.Segment)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+        return ErrorCorruptRecord
+}
+
+// RecoveryReport describes what Recover repaired in a segment after an unclean shutdown.
+type RecoveryReport struct {
+        Segment                 string  // path of the log file
+        Records                 int     // complete records kept in the log file
+        TruncatedBytes          int     // bytes of a torn trailing record dropped from the log file
+        CorruptedBytes          int     // bytes of corrupted records stepped over in the middle of the log file
+        IndexEntries            int     // index entries rebuilt from the log file
+        TimeIndexEntries        int     // time index entries rebuilt from the log file
+}
+
 type segment struct {
         path            string
         options         *Options
@@ -27,48 +80,225 @@ type segment struct {
         index           *Index
         timeindex       *timeIndex // timestamp index for retention policy
         baseOffset      int        // first record offset, same as file name
+        version         int        // segment format version
+        keyID           int        // id of the key the values are encrypted with, -1 for plaintext
+        aead            cipher.AEAD
         count           int        // relative offset in this segemnt
         position        int        // relative byte position in this segment file of next record
         isLoaded        bool
         isFull          bool
+        isSealed        bool       // no more records go to this segment, its indexes are memory mapped
+        isOpen          bool       // the log, index and time index files are open
+        refs            int        // iterators reading the segment, it is not closed meanwhile
+        generation      uint32     // bumped when the log file is truncated, rewritten or removed, iterators seek again then
+        retired         []*os.File // log files replaced by compaction while iterators read them
+        compactedAt     int        // next offset of the log when key compaction last left nothing to do here
+        lru             *list.Element
+        recovery        *RecoveryReport // set when Load had to repair this segment
+        readOnly        bool       // opened for inspection, see inspectSegment
 }
 
 func NewSegment(dir string, offset int, options *Options) (*segment, error) {
+        seg := newSegment(dir, offset, options)
+
+        if err := seg.open(); err != nil {
+                return nil, err
+        }
+
+        return seg, nil
+}
+
+// newSegment sets up the segment at offset without touching its files, they are opened and its header is read on first use.
+func newSegment(dir string, offset int, options *Options) *segment {
         name := fmt.Sprintf("%020d", offset)
-        path := filepath.Join(dir, name + SegExt)
 
-        f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+        return &segment{
+                path:           filepath.Join(dir, name + SegExt),
+                options:        options,
+                baseOffset:     offset,
+                keyID:          -1,
+        }
+}
+
+// open opens the log, index and time index files, again after Close. The header is read the first time.
+func (seg *segment) open() error {
+        dir := filepath.Dir(seg.path)
+
+        f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
         if err != nil {
-                return nil, err
+                return err
         }
 
-        idx, err := NewIndex(dir, offset, options)
+        idx, err := NewIndex(dir, seg.baseOffset, seg.options)
         if err != nil {
-                return nil, err
+                f.Close()
+                return err
         }
 
-        timeidx, err := NewTimeIndex(dir, offset, options)
+        timeidx, err := NewTimeIndex(dir, seg.baseOffset, seg.options)
         if err != nil {
-                return nil, err
+                f.Close()
+                idx.Close()
+                return err
         }
 
-        seg := &segment{
-                path:           path,
-                f:              f,
-                options:        options,
-                baseOffset:     offset,
-                index:          idx,
-                timeindex:      timeidx,
+        seg.f = f
+        seg.index = idx
+        seg.timeindex = timeidx
+        seg.isOpen = true
+
+        if seg.version == 0 {
+                if err := seg.readHeader(); err != nil {
+                        seg.isOpen = false
+                        f.Close()
+                        idx.Close()
+                        timeidx.Close()
+                        return err
+                }
         }
 
-        return seg, nil
+        return nil
+}
+
+// Segment header, absent in v1 segments, flags and key id are zero before v3
+// + ---------- + ------------ + ---------- + ----------- +
+// | Magic (4B) | Version (1B) | Flags (1B) | Key ID (2B) |
+// + ---------- + ------------ + ---------- + ----------- +
+func (seg *segment) readHeader() error {
+        header := make([]byte, segmentHeaderSize)
+        n, err := seg.f.ReadAt(header, 0)
+        if err != nil && err != io.EOF {
+                return err
+        }
+
+        if n == segmentHeaderSize && bytes.Equal(header[:4], segmentMagic) {
+                seg.version = int(header[4])
+                if seg.version > currentFormat {
+                        return ErrorUnsupportedFormat
+                }
+                if header[5] & segmentEncrypted != 0 {
+                        id := int(binary.LittleEndian.Uint16(header[6:8]))
+                        if seg.readOnly && seg.options.Encryption == nil {
+                                seg.keyID = id
+                                return nil
+                        }
+                        return seg.useKey(id)
+                }
+                return nil
+        }
+
+        // a new segment or one whose header write was torn, flags and key id may not be the ones about to be written
+        m := n
+        if m > 5 {
+                m = 5
+        }
+        if bytes.Equal(header[:m], seg.encodeSegmentHeader(currentFormat)[:m]) {
+                if seg.readOnly {
+                        seg.version = currentFormat
+                        return nil
+                }
+                return seg.writeHeader()
+        }
+
+        seg.version = formatV1
+
+        return nil
+}
+
+// writeHeader starts the segment over in the current format, encrypted with the current key if there is encryption.
+func (seg *segment) writeHeader() error {
+        seg.keyID, seg.aead = -1, nil
+        if seg.options.Encryption != nil {
+                id, key, err := seg.options.Encryption.Keys.CurrentKey()
+                if err != nil {
+                        return err
+                }
+                if seg.aead, err = newAEAD(key); err != nil {
+                        return err
+                }
+                seg.keyID = int(id)
+        }
+
+        if err := seg.f.Truncate(0); err != nil {
+                return err
+        }
+
+        if _, err := seg.f.Write(seg.encodeSegmentHeader(currentFormat)); err != nil {
+                return err
+        }
+        seg.version = currentFormat
+
+        return nil
+}
+
+// useKey looks up the key an existing segment is encrypted with.
+func (seg *segment) useKey(id int) error {
+        if seg.options.Encryption == nil {
+                return ErrorNoEncryption
+        }
+
+        key, err := seg.options.Encryption.Keys.Key(uint16(id))
+        if err != nil {
+                return err
+        }
+        if seg.aead, err = newAEAD(key); err != nil {
+                return err
+        }
+        seg.keyID = id
+
+        return nil
+}
+
+func (seg *segment) encodeSegmentHeader(version int) []byte {
+        buf := make([]byte, segmentHeaderSize)
+
+        copy(buf, segmentMagic)
+        buf[4] = byte(version)
+        if seg.aead != nil {
+                buf[5] |= segmentEncrypted
+                binary.LittleEndian.PutUint16(buf[6:], uint16(seg.keyID))
+        }
+
+        return buf
+}
+
+// encrypted reports whether the values of the segment are encrypted.
+func (seg *segment) encrypted() bool {
+        return seg.aead != nil
+}
+
+func (seg *segment) headerSize() int {
+        if seg.version == formatV1 {
+                return 0
+        }
+
+        return segmentHeaderSize
+}
+
+func (seg *segment) recordHeaderSize() int {
+        switch seg.version {
+        case formatV1:
+                return 2
+        case formatV2:
+                return 6
+        }
+
+        return recordV3HeaderSize
+}
+
+// recordSize returns the number of bytes following the record header.
+func (seg *segment) recordSize(header []byte) int {
+        if seg.version == formatV3 {
+                return int(binary.LittleEndian.Uint32(header[:4]))
+        }
+
+        return int(binary.LittleEndian.Uint16(header[:2]))
 }
 
 func (seg *segment) Load() error {
-        if err := seg.index.Load(); err != nil {
+        if err := seg.loadIndexes(); err != nil {
                 return err
         }
-        seg.count = seg.index.Count()
 
         fi, err := seg.f.Stat()
         if err != nil {
@@ -78,95 +308,595 @@ func (seg *segment) Load() error {
 
         seg.isLoaded = true
 
-        // inconsistency between log file and index file
-        if lastIndexPosition, ok := seg.index.Get(seg.count); !ok || lastIndexPosition != seg.position {
-                if err := seg.Recover(); err != nil {
+        // inconsistency between log file and index files
+        consistent, err := seg.loadTail()
+        if err != nil {
+                return err
+        }
+        if !consistent {
+                report, err := seg.Recover()
+                if err != nil {
                         return err
                 }
+                seg.recovery = report
+
+                // recovery rewrote the indexes of a sealed segment onto the heap
+                if seg.isSealed {
+                        return seg.loadIndexes()
+                }
         }
 
         return nil
 }
 
-//TODO
-func (seg *segment) Recover() error {
-        return nil
+// loadIndexes maps the index files of a sealed segment into memory, the active segment keeps its index on the heap.
+func (seg *segment) loadIndexes() error {
+        if !seg.isSealed {
+                return seg.index.Load()
+        }
+
+        if err := seg.index.mmap(); err != nil {
+                return err
+        }
+
+        return seg.timeindex.mmap()
+}
+
+// seal marks the segment as done with, its indexes get mapped the next time it is loaded.
+func (seg *segment) seal() error {
+        if err := seg.Sync(); err != nil {
+                return err
+        }
+        seg.isSealed = true
+
+        return seg.clearCache()
+}
+
+// unseal makes a sealed segment the active one again, after a truncation.
+func (seg *segment) unseal() error {
+        if !seg.isSealed {
+                return nil
+        }
+        seg.isSealed = false
+
+        return seg.clearCache()
+}
+
+// loadTail walks the records after the last index entry to find the next offset of the segment.
+// It returns false when the log file and the index files do not agree: the records do not end
+// exactly at the end of the log file or the time index does not end with the last record.
+// A log file ending with a partial batch is not consistent either, the batch is dropped by Recover.
+func (seg *segment) loadTail() (bool, error) {
+        if seg.index.stale {
+                return false, nil
+        }
+
+        entry, indexed := seg.index.last()
+        if !indexed {
+                entry.position = seg.headerSize()
+        }
+
+        first, last := -1, -1
+        continued := false
+        end, err := seg.walk(entry.position, seg.baseOffset + entry.offset, seg.position, func(rec *Record, position int, record []byte) bool {
+                if first < 0 {
+                        first = rec.Offset
+                }
+                last = rec.Offset
+                continued = rec.attributes & attrBatchContinued != 0
+                return true
+        })
+        if err != nil {
+                return false, err
+        }
+
+        if end != seg.position || continued || indexed != (first >= 0) || (indexed && first != seg.baseOffset + entry.offset) {
+                return false, nil
+        }
+
+        // the time index holds an entry for every record
+        lastTime, ok, err := seg.timeindex.lastOffset()
+        if err != nil {
+                return false, err
+        }
+        if ok != (last >= 0) || (ok && seg.baseOffset + lastTime != last) {
+                return false, nil
+        }
+
+        seg.count = 0
+        if last >= 0 {
+                seg.count = last - seg.baseOffset + 1
+        }
+
+        return true, nil
+}
+
+// recordEnd returns the byte position right after the record starting at position.
+func (seg *segment) recordEnd(position int) (int, error) {
+        buf := make([]byte, seg.recordHeaderSize())
+
+        if _, err := seg.f.ReadAt(buf, int64(position)); err != nil {
+                return -1, err
+        }
+
+        return position + len(buf) + seg.recordSize(buf), nil
+}
+
+// Recover rescans the log file record by record, drops a torn or corrupted tail
+// and rebuilds the index and time index entries which never made it to disk.
+func (seg *segment) Recover() (*RecoveryReport, error) {
+        return seg.recover(false)
+}
+
+// recover does what Recover does. With skip, corrupted records in the middle of the log file are stepped over
+// instead of being dropped along with everything after them, and the records after them get an index entry each.
+func (seg *segment) recover(skip bool) (*RecoveryReport, error) {
+        fi, err := seg.f.Stat()
+        if err != nil {
+                return nil, err
+        }
+        size := int(fi.Size())
+
+        offsets, positions, timestamps := make([]int, 0), make([]int, 0), make([]time.Time, 0)
+        committed := 0 // records up to the end of the last complete batch
+        end := seg.headerSize()
+        expected := seg.baseOffset
+        resumes := make(map[int]bool)
+        corrupted := 0
+
+        walk := func(position int, offset int, size int, fn func(rec *Record, position int, record []byte) bool) (int, error) {
+                return seg.walk(position, offset, size, fn)
+        }
+        if skip {
+                // the records after a corrupted one whose size is torn too are found at their index entries
+                entries := make([]indexEntry, seg.index.Count())
+                for i := range entries {
+                        entries[i] = seg.index.entry(i)
+                }
+
+                walk = func(position int, offset int, size int, fn func(rec *Record, position int, record []byte) bool) (int, error) {
+                        return seg.walkCorrupted(position, offset, size, entries, fn, func(position int, size int) {
+                                resumes[position + size] = true
+                                corrupted += size
+                        })
+                }
+        }
+
+        _, err = walk(seg.headerSize(), seg.baseOffset, size, func(rec *Record, position int, record []byte) bool {
+                // offsets only leave gaps behind in compacted segments, they never go back
+                if rec.Offset < expected {
+                        return false
+                }
+                expected = rec.Offset + 1
+
+                offsets = append(offsets, rec.Offset - seg.baseOffset)
+                positions = append(positions, position)
+                timestamps = append(timestamps, rec.Timestamp)
+
+                if rec.attributes & attrBatchContinued == 0 {
+                        committed = len(positions)
+                        end = position + len(record)
+                }
+                return true
+        })
+        if err != nil {
+                return nil, err
+        }
+        offsets, positions, timestamps = offsets[:committed], positions[:committed], timestamps[:committed]
+
+        report := &RecoveryReport{
+                Segment:        seg.path,
+                Records:        len(positions),
+                CorruptedBytes: corrupted,
+        }
+
+        if end < size {
+                if err := seg.f.Truncate(int64(end)); err != nil {
+                        return nil, err
+                }
+                report.TruncatedBytes = size - end
+        }
+
+        if report.IndexEntries, err = seg.index.rebuild(offsets, positions, resumes); err != nil {
+                return nil, err
+        }
+        // records before v3 do not keep the time of writing, the last modification is the best guess
+        if report.TimeIndexEntries, err = seg.timeindex.rebuild(offsets, timestamps, fi.ModTime()); err != nil {
+                return nil, err
+        }
+
+        seg.count = 0
+        if len(offsets) > 0 {
+                seg.count = offsets[len(offsets)-1] + 1
+        }
+        seg.position = end
+
+        return report, nil
+}
+
+// walk calls fn with every good record from position, the one of the record at offset, up to size bytes of the log file
+// together with its position and its encoded bytes, until fn returns false or a torn or corrupted record is met.
+// It returns the position right after the last record passed to fn.
+func (seg *segment) walk(position int, offset int, size int, fn func(rec *Record, position int, record []byte) bool) (int, error) {
+        r := bufio.NewReader(io.NewSectionReader(seg.f, int64(position), int64(size - position)))
+        header := make([]byte, seg.recordHeaderSize())
+        count := 0
+
+        for {
+                if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+                        break
+                } else if err != nil {
+                        return -1, err
+                }
+
+                n := seg.recordSize(header)
+                if n > size - position {
+                        break
+                }
+
+                record := make([]byte, len(header) + n)
+                copy(record, header)
+                if _, err := io.ReadFull(r, record[len(header):]); err == io.EOF || err == io.ErrUnexpectedEOF {
+                        break
+                } else if err != nil {
+                        return -1, err
+                }
+
+                // formats before v3 do not store offsets and are never compacted
+                rec, ok := seg.decodeSegmentRecord(record, offset + count)
+                if !ok {
+                        break
+                }
+
+                recs, ok, err := seg.expand(rec)
+                if err != nil {
+                        return -1, err
+                }
+                if !ok {
+                        break
+                }
+
+                done := false
+                for _, rec := range recs {
+                        if !fn(rec, position, record) {
+                                done = true
+                                break
+                        }
+                }
+                if done {
+                        break
+                }
+
+                count++
+                position += len(record)
+        }
+
+        return position, nil
+}
+
+// walkCorrupted walks like walk but steps over records in the middle of the log file which fail to decode.
+// It goes on right after such a record when its size is intact, or else at the first of entries behind it,
+// as long as a record decodes there. corrupted is called with the position and size of every range stepped over.
+func (seg *segment) walkCorrupted(position int, offset int, size int, entries []indexEntry, fn func(rec *Record, position int, record []byte) bool, corrupted func(position int, size int)) (int, error) {
+        for {
+                next, stopped := offset, false
+                end, err := seg.walk(position, offset, size, func(rec *Record, position int, record []byte) bool {
+                        next = rec.Offset + 1
+                        stopped = !fn(rec, position, record)
+                        return !stopped
+                })
+                if err != nil || stopped || end >= size {
+                        return end, err
+                }
+
+                resume, ok, err := seg.resumeAfter(end, next, size, entries)
+                if err != nil || !ok {
+                        return end, err
+                }
+                corrupted(end, resume.position - end)
+                position, offset = resume.position, seg.baseOffset + resume.offset
+        }
 }
 
-func (seg *segment) CheckFull(data []byte) bool {
+// resumeAfter returns the index entry of the first record which decodes after the corrupted one at position,
+// offset is the offset the corrupted record was expected to have. ok is false when there is none, a torn tail.
+func (seg *segment) resumeAfter(position int, offset int, size int, entries []indexEntry) (indexEntry, bool, error) {
+        candidates := make([]indexEntry, 0)
+        if end, err := seg.recordEnd(position); err == nil && end < size {
+                candidates = append(candidates, indexEntry{offset + 1 - seg.baseOffset, end})
+        } else if err != nil && err != io.EOF {
+                return indexEntry{}, false, err
+        }
+        for _, entry := range entries {
+                if entry.position > position && entry.position < size {
+                        candidates = append(candidates, entry)
+                }
+        }
+
+        for _, candidate := range candidates {
+                found := false
+                if _, err := seg.walk(candidate.position, seg.baseOffset + candidate.offset, size, func(*Record, int, []byte) bool {
+                        found = true
+                        return false
+                }); err != nil {
+                        return indexEntry{}, false, err
+                }
+                if found {
+                        return candidate, true, nil
+                }
+        }
+
+        return indexEntry{}, false, nil
+}
+
+// CheckFull reports whether recs have to go to a new segment.
+// An empty segment is never full, so that a batch bigger than MaxSegmentSize gets a segment of its own.
+func (seg *segment) CheckFull(recs []*Record) bool {
         if !seg.isLoaded {
                 seg.Load()
         }
 
-        if len(data) + seg.position > seg.options.MaxSegmentSize {
+        size := 0
+        for _, rec := range recs {
+                size += recordV3Size(rec)
+        }
+
+        if seg.count > 0 && size + seg.position > seg.options.MaxSegmentSize {
                 return true
         }
 
         return false
 }
 
-func (seg *segment) Write(data []byte) error {
-        if len(data) > maxRecordSize {
-                return ErrorExceedMaxRecordSize
+// Write appends recs, which carry their offsets, as one batch with a single write.
+// All but the last record are marked as continued, so that recovery drops a torn batch as a whole.
+// With a codec the batch is written as a single compressed record instead.
+func (seg *segment) Write(recs []*Record) error {
+        now := time.Now()
+        batch := make([]*Record, len(recs))
+
+        for i, rec := range recs {
+                copied := *rec
+                if copied.Timestamp.IsZero() {
+                        copied.Timestamp = now
+                }
+                copied.attributes = 0
+                if i < len(recs) - 1 {
+                        copied.attributes |= attrBatchContinued
+                }
+
+                batch[i] = &copied
         }
 
-        record := seg.encodeSegmentRecord(data)
+        records := batch
+        if seg.options.Codec != nil {
+                wrapper, err := compressBatch(seg.options.Codec, batch, seg.baseOffset)
+                if err != nil {
+                        return err
+                }
+                records = []*Record{wrapper}
+        }
 
-        n, err := seg.f.Write(record)
-        if err != nil {
+        // the records of a compressed batch all start where the batch does
+        positions := make([]int, len(batch))
+        for i := range positions {
+                positions[i] = seg.position
+        }
+
+        data := make([]byte, 0)
+        for i, rec := range records {
+                record, err := seg.encodeSegmentRecord(rec)
+                if err != nil {
+                        return err
+                }
+                if len(records) == len(batch) {
+                        positions[i] = seg.position + len(data)
+                }
+                data = append(data, record...)
+        }
+
+        if _, err := seg.f.Write(data); err != nil {
                 return err
         }
 
-        seg.index.Write(seg.count, seg.position)
-        seg.timeindex.Write(time.Now(), seg.count)
+        for i, rec := range batch {
+                seg.index.Write(rec.Offset - seg.baseOffset, positions[i])
+                seg.timeindex.Write(rec.Timestamp, rec.Offset - seg.baseOffset)
 
-        seg.count += 1
-        seg.position += n
+                seg.count = rec.Offset - seg.baseOffset + 1
+        }
+        seg.position += len(data)
 
         return nil
 }
 
-// Segemnt record
-// + --------------- + ----- +
-// | Value Size (2B) | Value |
-// + --------------- + ----- +
-func (seg *segment) encodeSegmentRecord(data []byte) []byte {
-        buf := make([]byte, 2 + len(data))
+// Segments are only written in the current format, the value is encrypted when the segment is.
+func (seg *segment) encodeSegmentRecord(rec *Record) ([]byte, error) {
+        if seg.encrypted() && rec.Value != nil {
+                value, err := encryptValue(seg.aead, rec.Value)
+                if err != nil {
+                        return nil, err
+                }
 
-        binary.LittleEndian.PutUint16(buf[:2], uint16(len(data)))
-        copy(buf[2:], data)
+                encrypted := *rec
+                encrypted.Value = value
+                encrypted.attributes |= attrEncrypted
+                rec = &encrypted
+        }
 
-        return buf
+        return encodeRecordV3(rec, rec.Offset - seg.baseOffset), nil
 }
 
-func (seg *segment) Read(offset int) ([]byte, error) {
-        from, to, err := seg.getRecordPosition(offset)
+// decodeSegmentRecord parses a record of this segment's format, ok is false when the record is torn or corrupted.
+// offset is only used for formats which do not store it.
+func (seg *segment) decodeSegmentRecord(record []byte, offset int) (rec *Record, ok bool) {
+        if seg.version == formatV3 {
+                return decodeRecordV3(record, seg.baseOffset)
+        }
+
+        size := seg.recordHeaderSize()
+        if len(record) < size || len(record) - size != seg.recordSize(record) {
+                return nil, false
+        }
+
+        value := record[size:]
+        if seg.version == formatV2 && binary.LittleEndian.Uint32(record[2:6]) != crc32.Checksum(value, crcTable) {
+                return nil, false
+        }
+
+        return &Record{Offset: offset, Value: value}, true
+}
+
+// expand returns the records of rec, which are more than one when rec is a compressed batch.
+// ok is false when the batch is corrupted.
+func (seg *segment) expand(rec *Record) ([]*Record, bool, error) {
+        if rec.attributes & attrEncrypted != 0 {
+                if !seg.encrypted() {
+                        // inspected without the key, the value is left sealed
+                        if seg.readOnly {
+                                return []*Record{rec}, true, nil
+                        }
+                        return nil, false, ErrorNoEncryption
+                }
+
+                value, err := decryptValue(seg.aead, rec.Value)
+                if err != nil {
+                        return nil, false, err
+                }
+                rec.Value = value
+                rec.attributes &^= attrEncrypted
+        }
+
+        if rec.attributes & attrCompressed == 0 {
+                return []*Record{rec}, true, nil
+        }
+
+        return decodeCompressedBatch(rec, seg.baseOffset)
+}
+
+func (seg *segment) Read(offset int) (*Record, error) {
+        if !seg.isLoaded {
+                if err := seg.Load(); err != nil {
+                        return nil, err
+                }
+        }
+
+        if offset < seg.baseOffset || offset >= seg.NextOffset() {
+                return nil, ErrorRecordNotFound
+        }
+
+        from, found, err := seg.seek(offset)
         if err != nil {
                 return nil, err
         }
+        if from >= seg.position {
+                return nil, ErrorRecordNotFound
+        }
 
-        data := make([]byte, to - from)
-
-        _, err = seg.f.ReadAt(data, int64(from))
+        recs, err := seg.readBatch(from, found)
         if err != nil {
                 return nil, err
         }
 
-        return data[2:], nil
+        for _, rec := range recs {
+                if rec.Offset == offset {
+                        return rec, nil
+                }
+        }
+
+        // compacted away
+        return nil, ErrorRecordNotFound
 }
 
-func (seg *segment) getRecordPosition(offset int) (from, to int, err error) {
-        position, ok := seg.index.Get(offset - seg.baseOffset)
-        if !ok {
-                return -1, -1, ErrorRecordNotFound
+// readBatch reads the record at position, whose offset is the one seek found,
+// and returns it or the records of the compressed batch it stands for.
+func (seg *segment) readBatch(position int, offset int) ([]*Record, error) {
+        to, err := seg.recordEnd(position)
+        if err != nil {
+                return nil, err
+        }
+
+        data := make([]byte, to - position)
+
+        _, err = seg.f.ReadAt(data, int64(position))
+        if err != nil {
+                return nil, err
+        }
+
+        rec, ok := seg.decodeSegmentRecord(data, offset)
+        if !ok || rec.Offset != offset {
+                return nil, &CorruptRecordError{Segment: seg.path, Offset: offset}
+        }
+
+        recs, ok, err := seg.expand(rec)
+        if err != nil {
+                return nil, err
         }
-        nextPosition, ok := seg.index.Get(offset - seg.baseOffset + 1)
-        //last record
         if !ok {
-                return position, seg.position, nil
+                return nil, &CorruptRecordError{Segment: seg.path, Offset: offset}
         }
 
-        return position, nextPosition, nil
+        return recs, nil
+}
+
+// seek returns the position and the offset of the first record at or after offset, scanning the log file
+// forward from the closest index entry before it. It returns the end of the segment when there is no such record.
+func (seg *segment) seek(offset int) (int, int, error) {
+        position, current := seg.headerSize(), seg.baseOffset
+        if entry, ok := seg.index.lookup(offset - seg.baseOffset); ok {
+                position, current = entry.position, seg.baseOffset + entry.offset
+        }
+
+        // enough of a record to tell its size and offset
+        need := seg.recordHeaderSize()
+        if seg.version == formatV3 {
+                need += 5
+        }
+
+        // records up to the next index entry mostly come with a single read
+        buf := make([]byte, seg.index.interval + need)
+        chunk, chunkStart := buf[:0], position
+
+        for position < seg.position {
+                if position + need > chunkStart + len(chunk) {
+                        n, err := seg.f.ReadAt(buf, int64(position))
+                        if err != nil && err != io.EOF {
+                                return -1, -1, err
+                        }
+                        if n < need {
+                                return -1, -1, &CorruptRecordError{Segment: seg.path, Offset: current}
+                        }
+                        chunk, chunkStart = buf[:n], position
+                }
+
+                header := chunk[position - chunkStart:]
+                found := current
+                if seg.version == formatV3 {
+                        found = seg.baseOffset + int(binary.LittleEndian.Uint32(header[recordV3HeaderSize+1:]))
+                }
+                if found >= offset {
+                        return position, found, nil
+                }
+
+                position += seg.recordHeaderSize() + seg.recordSize(header)
+                current = found + 1
+        }
+
+        return seg.position, seg.NextOffset(), nil
+}
+
+// size returns the byte position up to which the segment holds complete records.
+func (seg *segment) size() (int, error) {
+        if seg.isLoaded {
+                return seg.position, nil
+        }
+
+        fi, err := os.Stat(seg.path)
+        if err != nil {
+                return -1, err
+        }
+
+        return int(fi.Size()), nil
 }
 
 func (seg *segment) NextOffset() int {
@@ -175,34 +905,148 @@ func (seg *segment) NextOffset() int {
 
 func (seg *segment) clearCache() error {
         seg.index.clearCache()
+        seg.timeindex.clearCache()
+        seg.isLoaded = false
 
         return nil
 }
 
-func (seg *segment) Sync() (err error) {
-        err = seg.f.Sync()
-        err = seg.index.Sync()
+func (seg *segment) Sync() error {
+        if err := seg.f.Sync(); err != nil {
+                return err
+        }
+        if err := seg.index.Sync(); err != nil {
+                return err
+        }
+
+        return seg.timeindex.Sync()
+}
+
+// Close closes the files of the segment, it is loaded again after open.
+func (seg *segment) Close() error {
+        if !seg.isOpen {
+                return nil
+        }
 
-        return
+        if err := seg.Sync(); err != nil {
+                return err
+        }
+        if err := seg.index.Close(); err != nil {
+                return err
+        }
+        if err := seg.timeindex.Close(); err != nil {
+                return err
+        }
+        seg.isOpen = false
+        seg.isLoaded = false
+
+        return seg.f.Close()
 }
 
-func (seg *segment) Close() (err error) {
-        err = seg.f.Sync()
-        err = seg.index.Sync()
+// unref drops a reference taken by an iterator, log files replaced meanwhile are closed with the last one.
+func (seg *segment) unref() {
+        seg.refs--
+        if seg.refs > 0 {
+                return
+        }
 
-        return
+        for _, f := range seg.retired {
+                f.Close()
+        }
+        seg.retired = nil
 }
 
-func (seg *segment) Remove() (err error) {
-        err = seg.timeindex.Remove()
-        err = seg.index.Remove()
+func (seg *segment) Remove() error {
+        atomic.AddUint32(&seg.generation, 1)
+
+        if err := seg.Close(); err != nil {
+                return err
+        }
 
-        err = seg.f.Close()
-        err = os.Remove(seg.path)
+        // the index files of a segment which was never opened may not have been written yet
+        name := strings.TrimSuffix(seg.path, SegExt)
+        for _, path := range []string{name + TimeIndexExt, name + IndexExt} {
+                if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+                        return err
+                }
+        }
 
-        return
+        return os.Remove(seg.path)
 }
 
+// truncateTo cuts the log, index and time index right before the record at offset.
 func (seg *segment) truncateTo(offset int) error {
+        if !seg.isLoaded {
+                if err := seg.Load(); err != nil {
+                        return err
+                }
+        }
+
+        count := offset - seg.baseOffset
+        if count >= seg.count {
+                return nil
+        }
+
+        // the first record to drop, offsets may have been compacted away
+        position, found, err := seg.seek(offset)
+        if err != nil {
+                return err
+        }
+
+        // a compressed batch is cut as a whole, the records of it before offset are written again
+        kept := make([]*Record, 0)
+        if position < seg.position {
+                recs, err := seg.readBatch(position, found)
+                if err != nil {
+                        return err
+                }
+                for _, rec := range recs {
+                        if rec.Offset < offset {
+                                kept = append(kept, rec)
+                        }
+                }
+        }
+
+        atomic.AddUint32(&seg.generation, 1)
+
+        if position == seg.headerSize() {
+                // start over in the current format, legacy segments get upgraded in place
+                if err := seg.writeHeader(); err != nil {
+                        return err
+                }
+                position = seg.headerSize()
+        } else if err := seg.f.Truncate(int64(position)); err != nil {
+                return err
+        }
+
+        if len(kept) > 0 {
+                codec, err := codecByID(kept[0].codec)
+                if err != nil {
+                        return err
+                }
+                wrapper, err := compressBatch(codec, kept, seg.baseOffset)
+                if err != nil {
+                        return err
+                }
+                data, err := seg.encodeSegmentRecord(wrapper)
+                if err != nil {
+                        return err
+                }
+                if _, err := seg.f.Write(data); err != nil {
+                        return err
+                }
+                position += len(data)
+        }
+
+        if err := seg.index.truncate(count); err != nil {
+                return err
+        }
+        if err := seg.timeindex.truncate(count); err != nil {
+                return err
+        }
+
+        seg.count = count
+        seg.position = position
+
         return nil
 }
@@ -0,0 +1,417 @@
+// Package server exposes a CommitLog over HTTP.
+//
+//      POST /records                   append a record, {"offset": n}
+//      POST /records/batch             append records as a batch, {"first": n, "last": m}
+//      GET  /records/{offset}          read a record
+//      GET  /records?from=n&limit=m    read up to limit records from an offset on, {"records": [...]}
+//      GET  /offset?time=t             the first offset written at or after t, RFC 3339 or milliseconds since epoch
+//      GET  /offset                    the last offset of the log
+//      GET  /tail?from=n               Server-Sent Events of the records from an offset on, then of new appends
+//
+// Keys and values are base64 encoded in JSON, timestamps are milliseconds since epoch.
+// Errors come as {"error": "..."} with a status code matching the error of the log.
+package server
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+)
+
+const (
+        DefaultRangeLimit = 100
+        MaxRangeLimit     = 10000
+        MaxBatchSize      = 16 * 1024 * 1024 // bytes of a batch request body, raised to fit at least one record
+)
+
+var (
+        ErrorBadRequest = errors.New("Bad request")
+        ErrorNotFound = errors.New("Not found")
+        ErrorMethodNotAllowed = errors.New("Method not allowed")
+        ErrorBodyTooLarge = errors.New("Request body is too large")
+)
+
+// Record is the JSON representation of a commitlog.Record.
+type Record struct {
+        Offset          int             `json:"offset"`
+        Timestamp       int64           `json:"timestamp,omitempty"` // milliseconds since epoch, the time of writing when zero
+        Key             []byte          `json:"key"`
+        Headers         []Header        `json:"headers,omitempty"`
+        Value           []byte          `json:"value"`
+}
+
+type Header struct {
+        Key             string          `json:"key"`
+        Value           string          `json:"value"`
+}
+
+type AppendResponse struct {
+        Offset          int             `json:"offset"`
+}
+
+type BatchRequest struct {
+        Records         []Record        `json:"records"`
+}
+
+type BatchResponse struct {
+        First           int             `json:"first"`
+        Last            int             `json:"last"`
+}
+
+type RangeResponse struct {
+        Records         []Record        `json:"records"`
+}
+
+type OffsetResponse struct {
+        Offset          int             `json:"offset"`
+}
+
+type ErrorResponse struct {
+        Error           string          `json:"error"`
+}
+
+type Server struct {
+        log             *commitlog.CommitLog
+        mux             *http.ServeMux
+}
+
+func New(log *commitlog.CommitLog) *Server {
+        s := &Server{
+                log:            log,
+                mux:            http.NewServeMux(),
+        }
+
+        s.mux.HandleFunc("/records", s.handleRecords)
+        s.mux.HandleFunc("/records/", s.handleRecord)
+        s.mux.HandleFunc("/offset", s.handleOffset)
+        s.mux.HandleFunc("/tail", s.handleTail)
+
+        return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        s.mux.ServeHTTP(w, r)
+}
+
+// POST /records appends, GET /records reads a range
+func (s *Server) handleRecords(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodPost:
+                var rec Record
+                if err := decodeBody(w, r, recordBodySize(s.log.MaxRecordSize()), &rec); err != nil {
+                        writeError(w, err)
+                        return
+                }
+
+                offset, err := s.log.AppendRecord(ToRecord(rec))
+                if err != nil {
+                        writeError(w, err)
+                        return
+                }
+
+                writeJSON(w, http.StatusCreated, AppendResponse{Offset: offset})
+        case http.MethodGet:
+                s.readRange(w, r)
+        default:
+                writeError(w, ErrorMethodNotAllowed)
+        }
+}
+
+// POST /records/batch appends a batch, GET /records/{offset} reads a record
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+        name := strings.TrimPrefix(r.URL.Path, "/records/")
+
+        if name == "batch" {
+                if r.Method != http.MethodPost {
+                        writeError(w, ErrorMethodNotAllowed)
+                        return
+                }
+                s.appendBatch(w, r)
+                return
+        }
+
+        if r.Method != http.MethodGet {
+                writeError(w, ErrorMethodNotAllowed)
+                return
+        }
+
+        offset, err := strconv.Atoi(name)
+        if err != nil || offset < 0 {
+                writeError(w, ErrorBadRequest)
+                return
+        }
+
+        rec, err := s.log.ReadRecord(offset)
+        if err != nil {
+                writeError(w, err)
+                return
+        }
+
+        writeJSON(w, http.StatusOK, FromRecord(rec))
+}
+
+func (s *Server) appendBatch(w http.ResponseWriter, r *http.Request) {
+        limit := int64(MaxBatchSize)
+        if size := recordBodySize(s.log.MaxRecordSize()); size > limit {
+                limit = size
+        }
+
+        var req BatchRequest
+        if err := decodeBody(w, r, limit, &req); err != nil {
+                writeError(w, err)
+                return
+        }
+
+        recs := make([]*commitlog.Record, len(req.Records))
+        for i := range req.Records {
+                recs[i] = ToRecord(req.Records[i])
+        }
+
+        first, last, err := s.log.AppendRecords(recs)
+        if err != nil {
+                writeError(w, err)
+                return
+        }
+
+        writeJSON(w, http.StatusCreated, BatchResponse{First: first, Last: last})
+}
+
+func (s *Server) readRange(w http.ResponseWriter, r *http.Request) {
+        from, err := intParam(r, "from", 0)
+        if err != nil || from < 0 {
+                writeError(w, ErrorBadRequest)
+                return
+        }
+        limit, err := intParam(r, "limit", DefaultRangeLimit)
+        if err != nil || limit <= 0 || limit > MaxRangeLimit {
+                writeError(w, ErrorBadRequest)
+                return
+        }
+
+        it := s.log.NewIterator(from)
+        defer it.Close()
+
+        records := make([]Record, 0)
+        for len(records) < limit && it.Next() {
+                records = append(records, FromRecord(it.Record()))
+        }
+        if err := it.Err(); err != nil {
+                writeError(w, err)
+                return
+        }
+
+        writeJSON(w, http.StatusOK, RangeResponse{Records: records})
+}
+
+// GET /offset?time=t
+func (s *Server) handleOffset(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                writeError(w, ErrorMethodNotAllowed)
+                return
+        }
+
+        param := r.URL.Query().Get("time")
+        if param == "" {
+                writeJSON(w, http.StatusOK, OffsetResponse{Offset: s.log.Offset()})
+                return
+        }
+
+        tm, err := parseTime(param)
+        if err != nil {
+                writeError(w, ErrorBadRequest)
+                return
+        }
+
+        offset, err := s.log.OffsetForTime(tm)
+        if err != nil {
+                writeError(w, err)
+                return
+        }
+
+        writeJSON(w, http.StatusOK, OffsetResponse{Offset: offset})
+}
+
+// GET /tail?from=n streams records as Server-Sent Events, the id of every event is the offset of its record.
+// A reconnecting client with a Last-Event-ID header resumes after that offset.
+// The stream ends with an event of type error when reading fails, its data is an ErrorResponse.
+func (s *Server) handleTail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                writeError(w, ErrorMethodNotAllowed)
+                return
+        }
+
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+                writeError(w, errors.New("Streaming unsupported"))
+                return
+        }
+
+        from, err := intParam(r, "from", s.log.Offset() + 1)
+        if err != nil || from < 0 {
+                writeError(w, ErrorBadRequest)
+                return
+        }
+        if id := r.Header.Get("Last-Event-ID"); id != "" {
+                last, err := strconv.Atoi(id)
+                if err != nil {
+                        writeError(w, ErrorBadRequest)
+                        return
+                }
+                from = last + 1
+        }
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+
+        sub := s.log.Subscribe(r.Context(), from)
+        defer sub.Close()
+
+        for sub.Next() {
+                data, err := json.Marshal(FromRecord(sub.Record()))
+                if err != nil {
+                        return
+                }
+
+                if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", sub.Record().Offset, data); err != nil {
+                        return
+                }
+                flusher.Flush()
+        }
+
+        // a closed log ends the stream with an error event, a gone client needs none
+        if err := sub.Err(); err != nil && r.Context().Err() == nil {
+                data, _ := json.Marshal(ErrorResponse{Error: err.Error()})
+                fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+                flusher.Flush()
+        }
+}
+
+// ToRecord converts the JSON representation of a record.
+func ToRecord(rec Record) *commitlog.Record {
+        converted := &commitlog.Record{
+                Offset:         rec.Offset,
+                Key:            rec.Key,
+                Value:          rec.Value,
+        }
+        if rec.Timestamp != 0 {
+                converted.Timestamp = fromMillis(rec.Timestamp)
+        }
+        for _, h := range rec.Headers {
+                converted.Headers = append(converted.Headers, commitlog.Header{Key: h.Key, Value: h.Value})
+        }
+
+        return converted
+}
+
+// FromRecord converts a record to its JSON representation.
+func FromRecord(rec *commitlog.Record) Record {
+        converted := Record{
+                Offset:         rec.Offset,
+                Key:            rec.Key,
+                Value:          rec.Value,
+        }
+        if !rec.Timestamp.IsZero() {
+                converted.Timestamp = rec.Timestamp.UnixNano() / int64(time.Millisecond)
+        }
+        for _, h := range rec.Headers {
+                converted.Headers = append(converted.Headers, Header{Key: h.Key, Value: h.Value})
+        }
+
+        return converted
+}
+
+// StatusCode maps errors of the log to HTTP status codes.
+func StatusCode(err error) int {
+        switch {
+        case errors.Is(err, ErrorBadRequest), errors.Is(err, commitlog.ErrorEmptyBatch):
+                return http.StatusBadRequest
+        case errors.Is(err, ErrorNotFound), errors.Is(err, commitlog.ErrorRecordNotFound), errors.Is(err, commitlog.ErrorSegmentNotFound):
+                return http.StatusNotFound
+        case errors.Is(err, ErrorMethodNotAllowed):
+                return http.StatusMethodNotAllowed
+        case errors.Is(err, commitlog.ErrorRecordCompacted):
+                return http.StatusGone
+        case errors.Is(err, commitlog.ErrorExceedMaxRecordSize), errors.Is(err, ErrorBodyTooLarge):
+                return http.StatusRequestEntityTooLarge
+        case errors.Is(err, commitlog.ErrorClosed):
+                return http.StatusServiceUnavailable
+        case errors.Is(err, commitlog.ErrorAckTimeout):
+                return http.StatusGatewayTimeout
+        }
+
+        return http.StatusInternalServerError
+}
+
+// recordBodySize is the largest JSON body of a record of maxRecordSize, base64 grows values by a third.
+func recordBodySize(maxRecordSize int) int64 {
+        return int64(maxRecordSize) * 2 + 64 * 1024
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+        r               io.Reader
+        n               int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+        n, err := c.r.Read(p)
+        c.n += int64(n)
+
+        return n, err
+}
+
+// decodeBody decodes the JSON body of r into v, reading no more than limit bytes.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) error {
+        body := &countingReader{r: r.Body}
+        if err := json.NewDecoder(http.MaxBytesReader(w, ioutil.NopCloser(body), limit)).Decode(v); err != nil {
+                // MaxBytesReader reads one byte past the limit to tell that the body is too large
+                if body.n > limit {
+                        return ErrorBodyTooLarge
+                }
+                return ErrorBadRequest
+        }
+
+        return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+        writeJSON(w, StatusCode(err), ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(v)
+}
+
+func intParam(r *http.Request, name string, fallback int) (int, error) {
+        param := r.URL.Query().Get(name)
+        if param == "" {
+                return fallback, nil
+        }
+
+        return strconv.Atoi(param)
+}
+
+// parseTime accepts RFC 3339 or milliseconds since epoch.
+func parseTime(param string) (time.Time, error) {
+        if ms, err := strconv.ParseInt(param, 10, 64); err == nil {
+                return fromMillis(ms), nil
+        }
+
+        return time.Parse(time.RFC3339Nano, param)
+}
+
+func fromMillis(ms int64) time.Time {
+        return time.Unix(ms / 1000, (ms % 1000) * int64(time.Millisecond))
+}
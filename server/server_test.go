@@ -0,0 +1,198 @@
+package server
+
+import (
+        "bufio"
+        "bytes"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/HoMuChen/commitlog"
+)
+
+func newTestServer(t *testing.T, options *commitlog.Options) (*commitlog.CommitLog, *httptest.Server) {
+        cl, err := commitlog.New("test.db", options)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        return cl, httptest.NewServer(New(cl))
+}
+
+func cleanup(cl *commitlog.CommitLog, srv *httptest.Server) {
+        srv.Close()
+        cl.Close()
+        os.RemoveAll(cl.Path)
+}
+
+func post(t *testing.T, url string, body interface{}, v interface{}) int {
+        data, _ := json.Marshal(body)
+
+        resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+
+        if v != nil {
+                json.NewDecoder(resp.Body).Decode(v)
+        }
+
+        return resp.StatusCode
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+        resp, err := http.Get(url)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+
+        if v != nil {
+                json.NewDecoder(resp.Body).Decode(v)
+        }
+
+        return resp.StatusCode
+}
+
+func TestAppendAndRead(t *testing.T) {
+        cl, srv := newTestServer(t, nil)
+        defer cleanup(cl, srv)
+
+        var appended AppendResponse
+        rec := Record{Key: []byte(`k`), Value: []byte(`v`), Headers: []Header{{Key: "source", Value: "test"}}}
+        if status := post(t, srv.URL + "/records", rec, &appended); status != http.StatusCreated || appended.Offset != 0 {
+                t.Errorf("Expect 201 and offset 0 but got: %v, %+v", status, appended)
+        }
+
+        var batch BatchResponse
+        req := BatchRequest{Records: []Record{{Value: []byte(`a`)}, {Value: []byte(`b`)}}}
+        if status := post(t, srv.URL + "/records/batch", req, &batch); status != http.StatusCreated || batch.First != 1 || batch.Last != 2 {
+                t.Errorf("Expect 201 and offsets 1 to 2 but got: %v, %+v", status, batch)
+        }
+
+        var read Record
+        if status := get(t, srv.URL + "/records/0", &read); status != http.StatusOK || string(read.Key) != `k` || string(read.Value) != `v` || len(read.Headers) != 1 || read.Timestamp == 0 {
+                t.Errorf("Expect to read back the record but got: %v, %+v", status, read)
+        }
+
+        var rng RangeResponse
+        if status := get(t, srv.URL + "/records?from=1&limit=5", &rng); status != http.StatusOK || len(rng.Records) != 2 || string(rng.Records[1].Value) != `b` {
+                t.Errorf("Expect records 1 and 2 but got: %v, %+v", status, rng)
+        }
+
+        var offset OffsetResponse
+        if status := get(t, srv.URL + "/offset", &offset); status != http.StatusOK || offset.Offset != 2 {
+                t.Errorf("Expect last offset 2 but got: %v, %+v", status, offset)
+        }
+
+        from := time.Now().Add(-time.Minute).Format(time.RFC3339)
+        if status := get(t, srv.URL + "/offset?time=" + from, &offset); status != http.StatusOK || offset.Offset != 0 {
+                t.Errorf("Expect offset 0 but got: %v, %+v", status, offset)
+        }
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+        cl, srv := newTestServer(t, &commitlog.Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, MaxRecordSize: 100})
+        defer cleanup(cl, srv)
+
+        var resp ErrorResponse
+        if status := get(t, srv.URL + "/records/5", &resp); status != http.StatusNotFound || resp.Error != commitlog.ErrorRecordNotFound.Error() {
+                t.Errorf("Expect 404 but got: %v, %+v", status, resp)
+        }
+
+        if status := post(t, srv.URL + "/records", Record{Value: make([]byte, 200)}, nil); status != http.StatusRequestEntityTooLarge {
+                t.Errorf("Expect 413 but got: %v", status)
+        }
+
+        if status := post(t, srv.URL + "/records/batch", BatchRequest{}, nil); status != http.StatusBadRequest {
+                t.Errorf("Expect 400 for an empty batch but got: %v", status)
+        }
+
+        if status := get(t, srv.URL + "/records/abc", nil); status != http.StatusBadRequest {
+                t.Errorf("Expect 400 but got: %v", status)
+        }
+
+        if status := get(t, srv.URL + "/offset?time=" + time.Now().Add(time.Hour).Format(time.RFC3339), nil); status != http.StatusNotFound {
+                t.Errorf("Expect 404 but got: %v", status)
+        }
+
+        if StatusCode(commitlog.ErrorRecordCompacted) != http.StatusGone || StatusCode(commitlog.ErrorClosed) != http.StatusServiceUnavailable {
+                t.Errorf("Expect 410 for compacted records and 503 once closed")
+        }
+}
+
+func TestBodyTooLarge(t *testing.T) {
+        cl, err := commitlog.New("test.db", &commitlog.Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, MaxRecordSize: 100})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer func() {
+                cl.Close()
+                os.RemoveAll(cl.Path)
+        }()
+
+        cases := []struct {
+                path    string
+                body    string
+        }{
+                {"/records", `{"value":"` + strings.Repeat("A", int(recordBodySize(100))) + `"}`},
+                {"/records/batch", `{"records":[{"value":"` + strings.Repeat("A", MaxBatchSize) + `"}]}`},
+        }
+        for _, c := range cases {
+                w := httptest.NewRecorder()
+                New(cl).ServeHTTP(w, httptest.NewRequest("POST", c.path, strings.NewReader(c.body)))
+
+                var resp ErrorResponse
+                json.NewDecoder(w.Body).Decode(&resp)
+                if w.Code != http.StatusRequestEntityTooLarge || resp.Error != ErrorBodyTooLarge.Error() {
+                        t.Errorf("Expect 413 for %v but got: %v, %+v", c.path, w.Code, resp)
+                }
+        }
+
+        if offset := cl.Offset(); offset != -1 {
+                t.Errorf("Expect nothing to be appended but got offset: %v", offset)
+        }
+}
+
+func TestTail(t *testing.T) {
+        cl, srv := newTestServer(t, nil)
+        defer cleanup(cl, srv)
+
+        cl.Append([]byte(`a`))
+
+        resp, err := http.Get(srv.URL + "/tail?from=0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+
+        if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+                t.Errorf("Expect an event stream but got: %v", ct)
+        }
+
+        cl.Append([]byte(`b`))
+
+        r := bufio.NewReader(resp.Body)
+        values := make([]string, 0)
+        for len(values) < 2 {
+                line, err := r.ReadString('\n')
+                if err != nil {
+                        t.Fatal(err)
+                }
+
+                if strings.HasPrefix(line, "data: ") {
+                        var rec Record
+                        json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &rec)
+                        values = append(values, string(rec.Value))
+                }
+        }
+
+        if values[0] != `a` || values[1] != `b` {
+                t.Errorf("Expect a and b but got: %v", values)
+        }
+}
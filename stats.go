@@ -0,0 +1,108 @@
+package commitlog
+
+import (
+        "sync/atomic"
+        "time"
+)
+
+// Stats is a snapshot of the state of a log and of what it did since it was opened.
+type Stats struct {
+        Segments        int
+        OpenSegments    int       // segments whose files are open, see Options.MaxOpenSegments
+        Bytes           int64     // of the log files
+        OldestOffset    int       // -1 when the log is empty
+        NewestOffset    int       // -1 when the log is empty or its last offset was compacted away
+        OldestTime      time.Time // zero when the log is empty
+        NewestTime      time.Time // zero with NewestOffset -1
+        Appends         uint64    // records appended
+        AppendedBytes   uint64    // bytes written to the log files by appends
+        Reads           uint64    // calls of Read and ReadRecord
+        ReadTime        time.Duration // spent in Read and ReadRecord, ReadTime / Reads is the mean latency
+        Compactions     uint64    // runs of Compact
+        CompactionErrors uint64   // runs of Compact which failed
+        CompactedBytes  uint64    // bytes of log files removed or rewritten away by Compact
+}
+
+// counters are updated atomically, they are allocated apart from CommitLog to be 64-bit aligned.
+type counters struct {
+        appends         uint64
+        appendedBytes   uint64
+        reads           uint64
+        readNanos       uint64
+        compactions     uint64
+        compactionErrors uint64
+        compactedBytes  uint64
+}
+
+func (c *counters) appended(records int, bytes int) {
+        atomic.AddUint64(&c.appends, uint64(records))
+        atomic.AddUint64(&c.appendedBytes, uint64(bytes))
+}
+
+func (c *counters) read(d time.Duration) {
+        atomic.AddUint64(&c.reads, 1)
+        atomic.AddUint64(&c.readNanos, uint64(d))
+}
+
+func (c *counters) compacted(bytes int) {
+        if bytes > 0 {
+                atomic.AddUint64(&c.compactedBytes, uint64(bytes))
+        }
+}
+
+// Stats returns the current statistics of the log. The oldest and newest records are read to tell their time.
+func (cl *CommitLog) Stats() (*Stats, error) {
+        stats := &Stats{
+                Appends:        atomic.LoadUint64(&cl.counters.appends),
+                AppendedBytes:  atomic.LoadUint64(&cl.counters.appendedBytes),
+                Reads:          atomic.LoadUint64(&cl.counters.reads),
+                ReadTime:       time.Duration(atomic.LoadUint64(&cl.counters.readNanos)),
+                Compactions:    atomic.LoadUint64(&cl.counters.compactions),
+                CompactionErrors: atomic.LoadUint64(&cl.counters.compactionErrors),
+                CompactedBytes: atomic.LoadUint64(&cl.counters.compactedBytes),
+                OldestOffset:   -1,
+                NewestOffset:   -1,
+        }
+
+        cl.mu.Lock()
+        stats.Segments = len(cl.segments)
+        stats.OpenSegments = cl.lru.Len()
+        for _, seg := range cl.segments {
+                size, err := seg.size()
+                if err != nil {
+                        cl.mu.Unlock()
+                        return nil, err
+                }
+                stats.Bytes += int64(size)
+        }
+        first, last := cl.segments[0].baseOffset, cl.curSegment.NextOffset() - 1
+        cl.mu.Unlock()
+
+        if last < first {
+                return stats, nil
+        }
+
+        // the oldest segment may start with offsets compacted away
+        it := cl.NewIterator(first)
+        defer it.Close()
+        if it.Next() {
+                stats.OldestOffset = it.Record().Offset
+                stats.OldestTime = it.Record().Timestamp
+        }
+        if err := it.Err(); err != nil {
+                return nil, err
+        }
+
+        // the newest offset may have been compacted away at the end of a sealed segment
+        rec, err := cl.readRecord(last)
+        if err == ErrorRecordCompacted || err == ErrorRecordNotFound {
+                return stats, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        stats.NewestOffset = rec.Offset
+        stats.NewestTime = rec.Timestamp
+
+        return stats, nil
+}
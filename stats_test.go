@@ -0,0 +1,70 @@
+package commitlog
+
+import (
+        "testing"
+        "time"
+)
+
+func TestStats(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: -1, RetentionRecords: 3})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if stats, err := cl.Stats(); err != nil || stats.OldestOffset != -1 || stats.NewestOffset != -1 || stats.Segments != 1 || !stats.NewestTime.IsZero() {
+                t.Errorf("Expect an empty log but got: %+v, %v", stats, err)
+        }
+
+        old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+        cl.AppendRecord(&Record{Value: []byte(`0123456789`), Timestamp: old})
+        for i := 0; i < 4; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Read(0)
+        cl.Read(9)
+
+        stats, err := cl.Stats()
+        if err != nil || stats.Segments != 3 || stats.OldestOffset != 0 || stats.NewestOffset != 4 || !stats.OldestTime.Equal(old) || stats.NewestTime.Before(old) {
+                t.Errorf("Expect offsets 0 to 4 in 3 segments but got: %+v, %v", stats, err)
+        }
+        if stats.Appends != 5 || stats.AppendedBytes != 5 * 34 || stats.Bytes != 3 * 8 + 5 * 34 {
+                t.Errorf("Expect 5 appends of 34 bytes but got: %+v", stats)
+        }
+        if stats.Reads != 2 || stats.ReadTime <= 0 {
+                t.Errorf("Expect 2 reads but got: %+v", stats)
+        }
+
+        cl.Compact()
+
+        stats, _ = cl.Stats()
+        if stats.Compactions != 1 || stats.CompactedBytes != 2 * 34 + 8 || stats.OldestOffset != 2 || stats.Segments != 2 {
+                t.Errorf("Expect the first segment to be compacted away but got: %+v", stats)
+        }
+        if stats.Reads != 2 {
+                t.Errorf("Expect Stats not to count as reads but got: %v", stats.Reads)
+        }
+}
+
+func TestStatsNewestCompacted(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 70, CompactionInterval: time.Hour, RetentionPolicy: -1, KeyCompaction: true}) //two records per segment
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Value: []byte(`a`)})
+        cl.AppendRecord(&Record{Key: []byte(`k1`), Timestamp: time.Now().Add(-48 * time.Hour)}) //expired tombstone
+        cl.Append([]byte(`b`))
+        cl.Compact()
+
+        // an empty active segment after the sealed one whose records are all gone
+        if err := cl.Truncate(2); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+
+        stats, err := cl.Stats()
+        if err != nil || stats.NewestOffset != -1 || !stats.NewestTime.IsZero() || stats.OldestOffset != -1 {
+                t.Errorf("Expect no newest record but got: %+v, %v", stats, err)
+        }
+}
@@ -0,0 +1,79 @@
+package commitlog
+
+import (
+        "context"
+)
+
+// Subscription reads records from an offset onwards and then waits for new appends.
+// Every subscription reads the log at its own pace, a slow one never holds up Append.
+//
+//      sub := cl.Subscribe(ctx, offset)
+//      defer sub.Close()
+//      for sub.Next() {
+//              rec := sub.Record()
+//      }
+//      // sub.Err() is ctx.Err() once the context is done
+type Subscription struct {
+        ctx             context.Context
+        cl              *CommitLog
+        it              *Iterator
+        err             error
+}
+
+func (cl *CommitLog) Subscribe(ctx context.Context, offset int) *Subscription {
+        return &Subscription{
+                ctx:            ctx,
+                cl:             cl,
+                it:             cl.NewIterator(offset),
+        }
+}
+
+// Next blocks until the next record is available, the context is done or the log is closed.
+func (sub *Subscription) Next() bool {
+        if sub.err != nil {
+                return false
+        }
+
+        for {
+                // taken before reading, so that an append in between is not missed
+                appended := sub.cl.waitAppend()
+
+                if sub.it.Next() {
+                        return true
+                }
+                if err := sub.it.Err(); err != nil {
+                        sub.err = err
+                        return false
+                }
+
+                select {
+                case <- appended:
+                case <- sub.ctx.Done():
+                        sub.err = sub.ctx.Err()
+                        return false
+                case <- sub.cl.closed:
+                        sub.err = ErrorClosed
+                        return false
+                }
+        }
+}
+
+func (sub *Subscription) Record() *Record {
+        return sub.it.Record()
+}
+
+func (sub *Subscription) Err() error {
+        return sub.err
+}
+
+func (sub *Subscription) Close() error {
+        return sub.it.Close()
+}
+
+// waitAppend returns a channel which is closed by the next append.
+func (cl *CommitLog) waitAppend() <-chan struct{} {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        return cl.appended
+}
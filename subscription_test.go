@@ -0,0 +1,112 @@
+package commitlog
+
+import (
+        "context"
+        "fmt"
+        "sync"
+        "testing"
+        "time"
+)
+
+func TestSubscribe(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`123`))
+
+        ctx, cancel := context.WithCancel(context.Background())
+        sub := cl.Subscribe(ctx, 0)
+        defer sub.Close()
+
+        if !sub.Next() || string(sub.Record().Value) != `123` {
+                t.Errorf("Expect to read the existing record first")
+        }
+
+        go func() {
+                time.Sleep(10 * time.Millisecond)
+                cl.Append([]byte(`456`))
+        }()
+
+        if !sub.Next() || string(sub.Record().Value) != `456` {
+                t.Errorf("Expect to block until the next record is appended")
+        }
+
+        go func() {
+                time.Sleep(10 * time.Millisecond)
+                cancel()
+        }()
+
+        if sub.Next() {
+                t.Errorf("Expect no more records")
+        }
+        if sub.Err() != context.Canceled {
+                t.Errorf("Expect context.Canceled but got: %v", sub.Err())
+        }
+}
+
+func TestSubscribeConcurrently(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+
+        var wg sync.WaitGroup
+        for i := 0; i < 10; i++ {
+                wg.Add(1)
+                go func(slow bool) {
+                        defer wg.Done()
+
+                        sub := cl.Subscribe(ctx, 0)
+                        defer sub.Close()
+
+                        for expect := 0; expect < 100; expect++ {
+                                if !sub.Next() {
+                                        t.Errorf("Expect record %v but got: %v", expect, sub.Err())
+                                        return
+                                }
+                                if string(sub.Record().Value) != fmt.Sprint(expect) {
+                                        t.Errorf("Expect record %v but got: %s", expect, sub.Record().Value)
+                                }
+                                if slow {
+                                        time.Sleep(5 * time.Millisecond)
+                                }
+                        }
+                }(i == 0)
+        }
+
+        start := time.Now()
+        for i := 0; i < 100; i++ {
+                cl.Append([]byte(fmt.Sprint(i)))
+        }
+        if elapsed := time.Since(start); elapsed > 250 * time.Millisecond {
+                t.Errorf("Expect appends not to wait for the slow subscriber, but took: %v", elapsed)
+        }
+
+        wg.Wait()
+}
+
+func TestSubscribeClose(t *testing.T) {
+        cl, err := New("test.db", nil)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        sub := cl.Subscribe(context.Background(), 0)
+
+        go func() {
+                time.Sleep(10 * time.Millisecond)
+                cl.Close()
+        }()
+
+        if sub.Next() || sub.Err() != ErrorClosed {
+                t.Errorf("Expect ErrorClosed but got: %v", sub.Err())
+        }
+}
@@ -0,0 +1,73 @@
+package commitlog
+
+// SyncPolicy decides when appended records are fsynced to disk.
+// Records which are not synced yet survive a crash of the process but may be lost when the machine goes down.
+type SyncPolicy int
+
+const (
+        SyncNever       SyncPolicy = iota // left to the OS, records are only synced on Sync, Close and when a segment is sealed
+        SyncEveryAppend                   // Append returns once the records are on disk
+        SyncEveryN                        // every Options.SyncEveryN records
+        SyncInterval                      // every Options.SyncInterval by a background flusher
+)
+
+func (p SyncPolicy) String() string {
+        switch p {
+        case SyncNever:
+                return "never"
+        case SyncEveryAppend:
+                return "every append"
+        case SyncEveryN:
+                return "every n records"
+        case SyncInterval:
+                return "interval"
+        }
+
+        return "unknown"
+}
+
+// Sync flushes the index files and fsyncs the active segment, all records appended so far are then on disk.
+// Sealed segments were synced when the log rolled over.
+func (cl *CommitLog) Sync() error {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        return cl.sync()
+}
+
+func (cl *CommitLog) sync() error {
+        if err := cl.curSegment.Sync(); err != nil {
+                return err
+        }
+        cl.unsynced = 0
+
+        return nil
+}
+
+// syncAppended applies the sync policy after n records were appended, callers hold cl.mu.
+func (cl *CommitLog) syncAppended(n int) error {
+        cl.unsynced += n
+
+        switch cl.options.SyncPolicy {
+        case SyncEveryAppend:
+                return cl.sync()
+        case SyncEveryN:
+                if cl.unsynced >= cl.options.SyncEveryN {
+                        return cl.sync()
+                }
+        }
+
+        return nil
+}
+
+// syncUnsynced is run by the background flusher of the SyncInterval policy.
+func (cl *CommitLog) syncUnsynced() error {
+        cl.mu.Lock()
+        defer cl.mu.Unlock()
+
+        if cl.unsynced == 0 {
+                return nil
+        }
+
+        return cl.sync()
+}
@@ -0,0 +1,85 @@
+package commitlog
+
+import (
+        "os"
+        "testing"
+        "time"
+)
+
+func TestSyncEveryN(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, SyncPolicy: SyncEveryN, SyncEveryN: 3})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`))
+        cl.Append([]byte(`0123456789`))
+        if cl.unsynced != 2 {
+                t.Errorf("Expect 2 unsynced records but got: %v", cl.unsynced)
+        }
+
+        cl.Append([]byte(`0123456789`))
+        if cl.unsynced != 0 {
+                t.Errorf("Expect records to be synced after 3 appends but got: %v unsynced", cl.unsynced)
+        }
+}
+
+func TestSyncEveryAppend(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, SyncPolicy: SyncEveryAppend})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`))
+        if cl.unsynced != 0 {
+                t.Errorf("Expect no unsynced records but got: %v", cl.unsynced)
+        }
+
+        // the index entry is on disk as well, past the 8 bytes of header
+        fi, _ := os.Stat(cl.curSegment.index.Path)
+        if fi.Size() != 16 {
+                t.Errorf("Expect index file of 16 bytes but got: %v", fi.Size())
+        }
+}
+
+func TestSyncInterval(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour, SyncPolicy: SyncInterval, SyncInterval: 10 * time.Millisecond})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`))
+        time.Sleep(100 * time.Millisecond)
+
+        cl.mu.Lock()
+        unsynced := cl.unsynced
+        cl.mu.Unlock()
+        if unsynced != 0 {
+                t.Errorf("Expect the background flusher to sync but got: %v unsynced", unsynced)
+        }
+}
+
+func TestSync(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 1024, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        cl.Append([]byte(`0123456789`))
+        if cl.unsynced != 1 {
+                t.Errorf("Expect 1 unsynced record but got: %v", cl.unsynced)
+        }
+
+        if err := cl.Sync(); err != nil {
+                t.Error(err)
+        }
+
+        fi, _ := os.Stat(cl.curSegment.timeindex.path)
+        if cl.unsynced != 0 || fi.Size() != timeIndexRecordSize {
+                t.Errorf("Expect the time index entry on disk but got a file of %v bytes", fi.Size())
+        }
+}
@@ -4,14 +4,18 @@ import (
         "bufio"
         "encoding/binary"
         "fmt"
+        "io"
         "io/ioutil"
         "os"
         "path/filepath"
+        "sort"
         "time"
 )
 
 const (
         TimeIndexExt = ".timeindex"
+
+        timeIndexRecordSize = 12
 )
 
 type timeIndex struct {
@@ -19,8 +23,11 @@ type timeIndex struct {
         f               *os.File
         writer          *bufio.Writer
         baseOffset      int
+        lastCreatedAt   uint32 // entries are kept in time order
         createdAts      []uint32
         offsets         []uint64
+        mapped          []byte // the time index file mapped into memory, for sealed segments
+        isMapped        bool
 }
 
 func NewTimeIndex(dir string, offset int, options *Options) (*timeIndex, error) {
@@ -39,13 +46,29 @@ func NewTimeIndex(dir string, offset int, options *Options) (*timeIndex, error)
                 baseOffset:     offset,
         }
 
+        if n, err := idx.Count(); err != nil {
+                return nil, err
+        } else if n > 0 {
+                if idx.lastCreatedAt, _, err = idx.entry(n - 1); err != nil {
+                        return nil, err
+                }
+        }
+
         return idx, nil
 }
 
+// Write adds an entry, a timestamp earlier than the one of the previous entry is raised to it,
+// so that the entries can be binary searched.
 func (idx *timeIndex) Write(tm time.Time, offset int) error {
+        if createdAt := uint32(tm.Unix()); createdAt < idx.lastCreatedAt {
+                tm = time.Unix(int64(idx.lastCreatedAt), 0)
+        }
+
         data := idx.encodeTimeIndexRecord(tm, offset)
         _, err := idx.writer.Write(data)
 
+        idx.lastCreatedAt = uint32(tm.Unix())
+
         return err
 }
 
@@ -54,7 +77,7 @@ func (idx *timeIndex) Write(tm time.Time, offset int) error {
 // | Timestamp(seconds) (4B) | offset(8B) |
 // + ----------------------- + ---------- +
 func (idx *timeIndex) encodeTimeIndexRecord(tm time.Time, offset int) []byte {
-        buf := make([]byte, 12)
+        buf := make([]byte, timeIndexRecordSize)
 
         binary.LittleEndian.PutUint32(buf[:4], uint32(tm.Unix()))
         binary.LittleEndian.PutUint64(buf[4:], uint64(offset))
@@ -63,6 +86,10 @@ func (idx *timeIndex) encodeTimeIndexRecord(tm time.Time, offset int) []byte {
 }
 
 func (idx *timeIndex) load() error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
         idx.createdAts = make([]uint32, 0)
         idx.offsets = make([]uint64, 0)
         idx.f.Seek(0, 0)
@@ -72,7 +99,7 @@ func (idx *timeIndex) load() error {
                 return err
         }
 
-        for len(data) > 0 {
+        for len(data) >= timeIndexRecordSize {
                 createdAt := binary.LittleEndian.Uint32(data[:4])
                 data = data[4:]
 
@@ -86,11 +113,120 @@ func (idx *timeIndex) load() error {
         return nil
 }
 
+// mmap maps the time index file into memory, entries are then read from the page cache
+// rather than with a system call each. It is meant for sealed segments.
+func (idx *timeIndex) mmap() error {
+        if err := idx.Sync(); err != nil {
+                return err
+        }
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
+        fi, err := idx.f.Stat()
+        if err != nil {
+                return err
+        }
+
+        data, err := mmapFile(idx.f, int(fi.Size()))
+        if err != nil {
+                return err
+        }
+        idx.mapped = data
+        idx.isMapped = true
+
+        return nil
+}
+
+func (idx *timeIndex) unmap() error {
+        if !idx.isMapped {
+                return nil
+        }
+
+        data := idx.mapped
+        idx.mapped = nil
+        idx.isMapped = false
+
+        return munmapFile(data)
+}
+
+// Count returns the number of complete entries in the time index file, including buffered ones.
+func (idx *timeIndex) Count() (int, error) {
+        if idx.isMapped {
+                return len(idx.mapped) / timeIndexRecordSize, nil
+        }
+
+        fi, err := idx.f.Stat()
+        if err != nil {
+                return -1, err
+        }
+
+        return (int(fi.Size()) + idx.writer.Buffered()) / timeIndexRecordSize, nil
+}
+
+// rebuild keeps the entries of the records at offsets and fills in the missing ones
+// from timestamps, or with tm where those are unknown. It returns how many entries were filled in.
+func (idx *timeIndex) rebuild(offsets []int, timestamps []time.Time, tm time.Time) (int, error) {
+        if err := idx.Sync(); err != nil {
+                return 0, err
+        }
+        if err := idx.load(); err != nil {
+                return 0, err
+        }
+
+        kept := 0
+        for kept < len(offsets) && kept < len(idx.offsets) && int(idx.offsets[kept]) == offsets[kept] {
+                kept++
+        }
+        repaired := len(offsets) - kept
+
+        if repaired == 0 && len(idx.offsets) == len(offsets) {
+                return 0, nil
+        }
+
+        createdAts := make([]time.Time, len(offsets))
+        for i := range offsets {
+                if i < kept {
+                        createdAts[i] = time.Unix(int64(idx.createdAts[i]), 0)
+                } else if i < len(timestamps) && !timestamps[i].IsZero() {
+                        createdAts[i] = timestamps[i]
+                } else {
+                        createdAts[i] = tm
+                }
+        }
+
+        return repaired, idx.reset(offsets, createdAts)
+}
+
+// reset replaces all entries of the time index file.
+func (idx *timeIndex) reset(offsets []int, createdAts []time.Time) error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+        if err := idx.f.Truncate(0); err != nil {
+                return err
+        }
+        idx.writer.Reset(idx.f)
+        idx.lastCreatedAt = 0
+
+        for i, offset := range offsets {
+                if err := idx.Write(createdAts[i], offset); err != nil {
+                        return err
+                }
+        }
+
+        if err := idx.Sync(); err != nil {
+                return err
+        }
+
+        return idx.load()
+}
+
 func (idx *timeIndex) clearCache() error {
         idx.createdAts = make([]uint32, 0)
         idx.offsets = make([]uint64, 0)
 
-        return nil
+        return idx.unmap()
 }
 
 // -1 -> none
@@ -98,17 +234,133 @@ func (idx *timeIndex) clearCache() error {
 func (idx *timeIndex) lastOffsetBeforeTm(tm time.Time) (int, error) {
         timestamp := uint32(tm.Unix())
 
-        for i, createdAt := range idx.createdAts {
-                if createdAt > timestamp && i == 0 {
-                        return -1, nil
+        i, n, err := idx.search(func(createdAt uint32) bool {
+                return createdAt > timestamp
+        })
+        if err != nil {
+                return 0, err
+        }
+
+        if i == n {
+                return -2, nil
+        }
+        if i == 0 {
+                return -1, nil
+        }
+
+        return i-1, nil
+}
+
+// firstOffsetFromTm returns the first relative offset written at or after tm, ok is false when there is none.
+func (idx *timeIndex) firstOffsetFromTm(tm time.Time) (offset int, ok bool, err error) {
+        timestamp := uint32(tm.Unix())
+
+        i, n, err := idx.search(func(createdAt uint32) bool {
+                return createdAt >= timestamp
+        })
+        if err != nil || i == n {
+                return 0, false, err
+        }
+
+        _, offset, err = idx.entry(i)
+
+        return offset, err == nil, err
+}
+
+// lastOffset returns the relative offset of the last entry, ok is false when there is none.
+func (idx *timeIndex) lastOffset() (offset int, ok bool, err error) {
+        if err := idx.writer.Flush(); err != nil {
+                return 0, false, err
+        }
+
+        n, err := idx.Count()
+        if err != nil || n == 0 {
+                return 0, false, err
+        }
+
+        _, offset, err = idx.entry(n - 1)
+
+        return offset, err == nil, err
+}
+
+// truncate drops the entries at or after offset.
+func (idx *timeIndex) truncate(offset int) error {
+        if err := idx.writer.Flush(); err != nil {
+                return err
+        }
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
+        n, err := idx.Count()
+        if err != nil {
+                return err
+        }
+
+        i := sort.Search(n, func(i int) bool {
+                _, o, e := idx.entry(i)
+                if e != nil {
+                        err = e
+                        return true
+                }
+                return o >= offset
+        })
+        if err != nil {
+                return err
+        }
+
+        if err := idx.f.Truncate(int64(i * timeIndexRecordSize)); err != nil {
+                return err
+        }
+
+        idx.lastCreatedAt = 0
+        if i > 0 {
+                if idx.lastCreatedAt, _, err = idx.entry(i - 1); err != nil {
+                        return err
+                }
+        }
+
+        return idx.clearCache()
+}
+
+// search binary searches the entries on disk for the first one satisfying f and returns it
+// together with the number of entries. f must hold for every entry after the first one it holds for.
+func (idx *timeIndex) search(f func(createdAt uint32) bool) (int, int, error) {
+        if err := idx.writer.Flush(); err != nil {
+                return 0, 0, err
+        }
+
+        n, err := idx.Count()
+        if err != nil {
+                return 0, 0, err
+        }
+
+        i := sort.Search(n, func(i int) bool {
+                createdAt, _, e := idx.entry(i)
+                if e != nil {
+                        err = e
+                        return true
                 }
+                return f(createdAt)
+        })
+
+        return i, n, err
+}
+
+// entry reads the i-th entry from the mapped file or from disk
+func (idx *timeIndex) entry(i int) (uint32, int, error) {
+        buf := make([]byte, timeIndexRecordSize)
 
-                if createdAt > timestamp {
-                        return i-1, nil
+        if idx.isMapped {
+                if (i + 1) * timeIndexRecordSize > len(idx.mapped) {
+                        return 0, 0, io.EOF
                 }
+                buf = idx.mapped[i * timeIndexRecordSize:]
+        } else if _, err := idx.f.ReadAt(buf, int64(i * timeIndexRecordSize)); err != nil {
+                return 0, 0, err
         }
 
-        return -2, nil
+        return binary.LittleEndian.Uint32(buf[:4]), int(binary.LittleEndian.Uint64(buf[4:])), nil
 }
 
 func (idx *timeIndex) Sync() error {
@@ -116,6 +368,10 @@ func (idx *timeIndex) Sync() error {
 }
 
 func (idx *timeIndex) Close() error {
+        if err := idx.unmap(); err != nil {
+                return err
+        }
+
         return idx.f.Close()
 }
 
@@ -41,3 +41,32 @@ func TestTimeIndexWrite(t *testing.T) {
                 t.Errorf("Expect 0 but got: %v", offset)
         }
 }
+
+func TestTimeIndexKeepsTimeOrder(t *testing.T) {
+        setupDir(TIMEINDEX_DIR)
+        defer cleanupDir(TIMEINDEX_DIR)
+
+        timeindex, err := NewTimeIndex(TIMEINDEX_DIR, 0, nil)
+        if err != nil {
+                t.Error(err)
+        }
+
+        now := time.Now()
+        timeindex.Write(now, 0)
+        timeindex.Write(now.Add(-1 * time.Hour), 1)
+        timeindex.Write(now.Add(1 * time.Hour), 2)
+
+        offset, ok, _ := timeindex.firstOffsetFromTm(now.Add(-2 * time.Hour))
+        if !ok || offset != 0 {
+                t.Errorf("Expect 0 but got: %v", offset)
+        }
+
+        offset, ok, _ = timeindex.firstOffsetFromTm(now.Add(1 * time.Minute))
+        if !ok || offset != 2 {
+                t.Errorf("Expect 2 but got: %v", offset)
+        }
+
+        if _, ok, _ = timeindex.firstOffsetFromTm(now.Add(2 * time.Hour)); ok {
+                t.Errorf("Expect no offset after the last entry")
+        }
+}
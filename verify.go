@@ -0,0 +1,362 @@
+package commitlog
+
+import (
+        "fmt"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// IssueKind is the kind of an inconsistency found by Verify.
+type IssueKind int
+
+const (
+        IssueTornTail     IssueKind = iota // bytes after the last complete record of a log file
+        IssueOffsetOrder                   // offsets within a log file which do not increase
+        IssueIndex                         // index entries which do not point at record boundaries or the index file is invalid
+        IssueTimeIndex                     // time index entries which are not monotonic or do not match the records
+        IssueOrphan                        // an index or time index file without its log file
+        IssueOffsetGap                     // offsets missing between two segments, expected with key compaction
+        IssueOffsetOverlap                 // a segment starting at or before the last offset of the one before
+        IssueCorruptRecord                 // records which do not decode in the middle of a log file, complete ones follow
+)
+
+func (k IssueKind) String() string {
+        switch k {
+        case IssueTornTail:
+                return "torn tail"
+        case IssueOffsetOrder:
+                return "offset order"
+        case IssueIndex:
+                return "index"
+        case IssueTimeIndex:
+                return "time index"
+        case IssueOrphan:
+                return "orphan"
+        case IssueOffsetGap:
+                return "offset gap"
+        case IssueOffsetOverlap:
+                return "offset overlap"
+        case IssueCorruptRecord:
+                return "corrupt record"
+        }
+
+        return "unknown"
+}
+
+// Issue is an inconsistency found by Verify.
+type Issue struct {
+        Kind            IssueKind
+        Path            string  // file the issue is in
+        Offset          int     // offset the issue is at, -1 when it is about the whole file
+        Message         string
+}
+
+func (i *Issue) String() string {
+        if i.Offset < 0 {
+                return fmt.Sprintf("%s: %s: %s", i.Path, i.Kind, i.Message)
+        }
+
+        return fmt.Sprintf("%s: %s at offset %d: %s", i.Path, i.Kind, i.Offset, i.Message)
+}
+
+// Repairable reports whether Repair fixes the issue, gaps and overlaps between segments are left alone
+// and corrupted records are only cut off when Repair is asked to truncate.
+func (i *Issue) Repairable() bool {
+        return i.Kind != IssueOffsetGap && i.Kind != IssueOffsetOverlap && i.Kind != IssueOffsetOrder && i.Kind != IssueCorruptRecord
+}
+
+type VerifyReport struct {
+        Segments        []*SegmentInfo
+        Issues          []*Issue
+}
+
+// Verify checks the segments of dir against their indexes without opening the log and without writing,
+// so it also works while the owning process is down. options are only needed to decrypt and to tell whether
+// key compaction runs, which leaves gaps between segments behind, they may be nil.
+func Verify(dir string, options *Options) (*VerifyReport, error) {
+        if options == nil {
+                options = &Options{}
+        }
+
+        offsets, err := SegmentOffsets(dir)
+        if err != nil {
+                return nil, err
+        }
+
+        report := &VerifyReport{
+                Segments:       make([]*SegmentInfo, 0, len(offsets)),
+                Issues:         make([]*Issue, 0),
+        }
+
+        orphans, err := orphanIndexes(dir, offsets)
+        if err != nil {
+                return nil, err
+        }
+        for _, path := range orphans {
+                report.Issues = append(report.Issues, &Issue{Kind: IssueOrphan, Path: path, Offset: -1, Message: "no log file"})
+        }
+
+        for i, offset := range offsets {
+                info, issues, err := verifySegment(dir, offset, options)
+                if err != nil {
+                        return nil, err
+                }
+                report.Segments = append(report.Segments, info)
+                report.Issues = append(report.Issues, issues...)
+
+                if i == 0 {
+                        continue
+                }
+
+                // the last offset of an emptied segment is unknown, its base offset is the closest one
+                prev := report.Segments[i-1]
+                last := prev.LastOffset
+                if last < 0 {
+                        last = prev.BaseOffset - 1
+                }
+
+                if offset <= last {
+                        report.Issues = append(report.Issues, &Issue{Kind: IssueOffsetOverlap, Path: info.Path, Offset: offset,
+                                Message: fmt.Sprintf("the segment before ends at offset %d", last)})
+                } else if offset > last + 1 && !options.KeyCompaction {
+                        report.Issues = append(report.Issues, &Issue{Kind: IssueOffsetGap, Path: info.Path, Offset: offset,
+                                Message: fmt.Sprintf("offsets %d to %d are missing", last + 1, offset - 1)})
+                }
+        }
+
+        return report, nil
+}
+
+// verifySegment walks the log file of a segment and checks its index and time index against the records.
+func verifySegment(dir string, offset int, options *Options) (*SegmentInfo, []*Issue, error) {
+        issues := make([]*Issue, 0)
+
+        // first offsets at every record position, sealed values without their key hide the offsets of a compressed batch
+        starts := make(map[int]int)
+        offsets := make([]int, 0)
+        sealed := false
+        prev := -1
+
+        path := filepath.Join(dir, fmt.Sprintf("%020d", offset) + SegExt)
+        info, err := inspect(dir, offset, options, func(rec *Record, position int) {
+                if rec.attributes & attrEncrypted != 0 {
+                        sealed = true
+                }
+                if _, ok := starts[position]; !ok {
+                        starts[position] = rec.Offset
+                }
+                if rec.Offset <= prev {
+                        issues = append(issues, &Issue{Kind: IssueOffsetOrder, Path: path,
+                                Offset: rec.Offset, Message: fmt.Sprintf("follows offset %d", prev)})
+                }
+                prev = rec.Offset
+                offsets = append(offsets, rec.Offset)
+        }, func(position int, size int) {
+                // the offset the first corrupted record was expected to have
+                expected := offset
+                if prev >= 0 {
+                        expected = prev + 1
+                }
+                issues = append(issues, &Issue{Kind: IssueCorruptRecord, Path: path, Offset: expected,
+                        Message: fmt.Sprintf("%d bytes at position %d do not decode", size, position)})
+        })
+        if err != nil {
+                return nil, nil, err
+        }
+
+        if info.TornBytes > 0 {
+                issues = append(issues, &Issue{Kind: IssueTornTail, Path: info.Path, Offset: -1,
+                        Message: fmt.Sprintf("%d bytes after the last record", info.TornBytes)})
+        }
+
+        name := filepath.Join(dir, fmt.Sprintf("%020d", offset))
+        issues = append(issues, verifyIndex(name + IndexExt, dir, offset, starts, sealed)...)
+        issues = append(issues, verifyTimeIndex(name + TimeIndexExt, dir, offset, offsets, sealed)...)
+
+        return info, issues, nil
+}
+
+func verifyIndex(path string, dir string, base int, starts map[int]int, sealed bool) []*Issue {
+        entries, err := IndexEntries(dir, base)
+        if err != nil {
+                return []*Issue{{Kind: IssueIndex, Path: path, Offset: -1, Message: err.Error()}}
+        }
+
+        issues := make([]*Issue, 0)
+        if len(starts) > 0 && len(entries) == 0 {
+                issues = append(issues, &Issue{Kind: IssueIndex, Path: path, Offset: -1, Message: "the first record is not indexed"})
+        }
+
+        for i, entry := range entries {
+                first, ok := starts[entry.Position]
+                switch {
+                case !ok:
+                        issues = append(issues, &Issue{Kind: IssueIndex, Path: path, Offset: entry.Offset,
+                                Message: fmt.Sprintf("position %d is not a record boundary", entry.Position)})
+                case first != entry.Offset && !sealed:
+                        issues = append(issues, &Issue{Kind: IssueIndex, Path: path, Offset: entry.Offset,
+                                Message: fmt.Sprintf("the record at position %d has offset %d", entry.Position, first)})
+                case i > 0 && (entry.Offset <= entries[i-1].Offset || entry.Position <= entries[i-1].Position):
+                        issues = append(issues, &Issue{Kind: IssueIndex, Path: path, Offset: entry.Offset, Message: "entries are out of order"})
+                }
+        }
+
+        return issues
+}
+
+func verifyTimeIndex(path string, dir string, base int, offsets []int, sealed bool) []*Issue {
+        entries, err := TimeIndexEntries(dir, base)
+        if err != nil {
+                return []*Issue{{Kind: IssueTimeIndex, Path: path, Offset: -1, Message: err.Error()}}
+        }
+
+        issues := make([]*Issue, 0)
+        for i := 1; i < len(entries); i++ {
+                if entries[i].Offset <= entries[i-1].Offset {
+                        issues = append(issues, &Issue{Kind: IssueTimeIndex, Path: path, Offset: entries[i].Offset,
+                                Message: fmt.Sprintf("follows offset %d", entries[i-1].Offset)})
+                }
+                if entries[i].Time.Before(entries[i-1].Time) {
+                        issues = append(issues, &Issue{Kind: IssueTimeIndex, Path: path, Offset: entries[i].Offset,
+                                Message: "its time is before the one of the entry before"})
+                }
+        }
+
+        // every record has an entry, which cannot be told for a compressed batch whose key is missing
+        if sealed {
+                return issues
+        }
+        for i, offset := range offsets {
+                if i >= len(entries) {
+                        issues = append(issues, &Issue{Kind: IssueTimeIndex, Path: path, Offset: offset,
+                                Message: fmt.Sprintf("%d records have no entry", len(offsets) - i)})
+                        break
+                }
+                if entries[i].Offset != offset {
+                        issues = append(issues, &Issue{Kind: IssueTimeIndex, Path: path, Offset: offset,
+                                Message: fmt.Sprintf("the entry of the record is for offset %d", entries[i].Offset)})
+                        break
+                }
+        }
+        if len(entries) > len(offsets) {
+                issues = append(issues, &Issue{Kind: IssueTimeIndex, Path: path, Offset: entries[len(offsets)].Offset,
+                        Message: fmt.Sprintf("%d entries have no record", len(entries) - len(offsets))})
+        }
+
+        return issues
+}
+
+// orphanIndexes returns the index and time index files of dir whose log file is missing.
+func orphanIndexes(dir string, offsets []int) ([]string, error) {
+        files, err := ioutil.ReadDir(dir)
+        if err != nil {
+                return nil, err
+        }
+
+        segments := make(map[int]bool)
+        for _, offset := range offsets {
+                segments[offset] = true
+        }
+
+        orphans := make([]string, 0)
+        for _, file := range files {
+                name := file.Name()
+                ext := filepath.Ext(name)
+                if ext != IndexExt && ext != TimeIndexExt {
+                        continue
+                }
+
+                offset, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+                if err != nil || !segments[offset] {
+                        orphans = append(orphans, filepath.Join(dir, name))
+                }
+        }
+
+        return orphans, nil
+}
+
+// Repair verifies dir and fixes what can be fixed: torn tails are cut off, indexes and time indexes with issues
+// are rebuilt from the log files and orphan index files are removed. It returns the report from before the repair.
+// Corrupted records in the middle of a log file are stepped over and the records after them are kept and indexed,
+// with truncate the log file is cut at the first corrupted record instead, as it is when a log is opened.
+// The log must not be open meanwhile. Time index entries of records before format v3, which carry no time,
+// are kept when they match their record and take the time of the last change of the log file otherwise.
+func Repair(dir string, options *Options, truncate bool) (*VerifyReport, error) {
+        if options == nil {
+                options = &Options{}
+        }
+
+        report, err := Verify(dir, options)
+        if err != nil {
+                return nil, err
+        }
+
+        broken := make(map[string]bool)
+        for _, issue := range report.Issues {
+                switch issue.Kind {
+                case IssueOrphan:
+                        if err := os.Remove(issue.Path); err != nil {
+                                return nil, err
+                        }
+                case IssueTornTail, IssueIndex, IssueTimeIndex, IssueCorruptRecord:
+                        broken[issue.Path] = true
+                }
+        }
+
+        for _, info := range report.Segments {
+                name := strings.TrimSuffix(info.Path, SegExt)
+                if !broken[info.Path] && !broken[name + IndexExt] && !broken[name + TimeIndexExt] {
+                        continue
+                }
+
+                if err := repairSegment(dir, info.BaseOffset, options, broken[name + TimeIndexExt], truncate); err != nil {
+                        return nil, err
+                }
+        }
+
+        return report, nil
+}
+
+// repairSegment rebuilds the indexes of a segment like Recover, a time index out of order is started over.
+// Corrupted records are stepped over unless truncate is set.
+func repairSegment(dir string, offset int, options *Options, resetTimeIndex bool, truncate bool) error {
+        seg, err := NewSegment(dir, offset, options.withDefaults())
+        if err != nil {
+                return err
+        }
+        defer seg.Close()
+
+        if resetTimeIndex {
+                if err := seg.timeindex.load(); err != nil {
+                        return err
+                }
+                if err := seg.timeindex.reset(timeIndexPrefix(seg.timeindex)); err != nil {
+                        return err
+                }
+        }
+        if err := seg.index.Load(); err != nil {
+                return err
+        }
+
+        _, err = seg.recover(!truncate)
+
+        return err
+}
+
+// timeIndexPrefix returns the entries of a time index up to the first one out of order.
+func timeIndexPrefix(idx *timeIndex) ([]int, []time.Time) {
+        offsets, createdAts := make([]int, 0), make([]time.Time, 0)
+        for i := range idx.offsets {
+                if i > 0 && (idx.offsets[i] <= idx.offsets[i-1] || idx.createdAts[i] < idx.createdAts[i-1]) {
+                        break
+                }
+                offsets = append(offsets, int(idx.offsets[i]))
+                createdAts = append(createdAts, time.Unix(int64(idx.createdAts[i]), 0))
+        }
+
+        return offsets, createdAts
+}
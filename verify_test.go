@@ -0,0 +1,178 @@
+package commitlog
+
+import (
+        "encoding/binary"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+func appendToFile(path string, data []byte) {
+        f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+        f.Write(data)
+        f.Close()
+}
+
+func issueKinds(report *VerifyReport) map[IssueKind]int {
+        kinds := make(map[IssueKind]int)
+        for _, issue := range report.Issues {
+                kinds[issue.Kind]++
+        }
+
+        return kinds
+}
+
+func TestVerify(t *testing.T) {
+        options := &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Close()
+
+        report, err := Verify("test.db", nil)
+        if err != nil || len(report.Segments) != 4 || len(report.Issues) != 0 {
+                os.RemoveAll("test.db")
+                t.Fatalf("Expect 4 segments without issues but got: %+v, %v", report, err)
+        }
+
+        first := filepath.Join("test.db", "00000000000000000000")
+        appendToFile(first + SegExt, []byte(`torn`))
+
+        // an entry in the middle of the second record
+        entry := make([]byte, indexEntrySize)
+        binary.LittleEndian.PutUint32(entry[0:4], 1)
+        binary.LittleEndian.PutUint32(entry[4:8], segmentHeaderSize + 10)
+        appendToFile(first + IndexExt, entry)
+
+        // an entry going back in time and offsets
+        entry = make([]byte, timeIndexRecordSize)
+        binary.LittleEndian.PutUint64(entry[4:12], 0)
+        appendToFile(filepath.Join("test.db", "00000000000000000002" + TimeIndexExt), entry)
+
+        appendToFile(filepath.Join("test.db", "00000000000000000099" + IndexExt), []byte{})
+
+        report, err = Verify("test.db", nil)
+        kinds := issueKinds(report)
+        if err != nil || kinds[IssueTornTail] != 1 || kinds[IssueIndex] != 1 || kinds[IssueTimeIndex] == 0 || kinds[IssueOrphan] != 1 {
+                t.Errorf("Expect torn tail, index, time index and orphan issues but got: %v, %v", report.Issues, err)
+        }
+        if fi, _ := os.Stat(first + SegExt); int(fi.Size()) != report.Segments[0].Size {
+                t.Errorf("Expect Verify to leave the files alone")
+        }
+
+        if _, err := Repair("test.db", nil, false); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        if report, err = Verify("test.db", nil); err != nil || len(report.Issues) != 0 {
+                t.Errorf("Expect no issues after the repair but got: %v, %v", report.Issues, err)
+        }
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        if data, err := cl.Read(1); err != nil || string(data) != `0123456789` {
+                t.Errorf("Expect to read the record but got: %s, %v", data, err)
+        }
+        if reports := cl.Recoveries(); len(reports) != 0 {
+                t.Errorf("Expect no recovery after the repair but got: %+v", reports[0])
+        }
+}
+
+func TestVerifyOffsetGap(t *testing.T) {
+        cl, err := New("test.db", &Options{MaxSegmentSize: 80, CompactionInterval: time.Hour, RetentionPolicy: time.Hour})
+        if err != nil {
+                t.Error(err)
+        }
+        defer cleanup(cl)
+
+        for i := 0; i < 5; i++ {
+                cl.Append([]byte(`0123456789`))
+        }
+        cl.Close()
+
+        for _, ext := range []string{SegExt, IndexExt, TimeIndexExt} {
+                os.Remove(filepath.Join("test.db", "00000000000000000002" + ext))
+        }
+
+        report, err := Verify("test.db", nil)
+        if err != nil || len(report.Issues) != 1 || report.Issues[0].Kind != IssueOffsetGap || report.Issues[0].Offset != 4 || report.Issues[0].Repairable() {
+                t.Errorf("Expect a gap before offset 4 but got: %v, %v", report.Issues, err)
+        }
+
+        if report, _ := Verify("test.db", &Options{KeyCompaction: true}); len(report.Issues) != 0 {
+                t.Errorf("Expect gaps to be expected with key compaction but got: %v", report.Issues)
+        }
+}
+
+func writeToFile(path string, position int, data []byte) {
+        f, _ := os.OpenFile(path, os.O_WRONLY, 0666)
+        f.WriteAt(data, int64(position))
+        f.Close()
+}
+
+func TestRepairCorruptRecord(t *testing.T) {
+        options := &Options{MaxSegmentSize: 1024, IndexIntervalBytes: 60, CompactionInterval: time.Hour, RetentionPolicy: time.Hour}
+        cl, err := New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+
+        for i := 0; i < 7; i++ {
+                cl.Append([]byte(`0123456789`)) //34 bytes per record, offsets 0, 2, 4 and 6 are indexed
+        }
+        cl.Close()
+
+        // the value of offset 1, the size of offset 4 and the value of offset 5, the walk goes on at the index entry of offset 6
+        path := filepath.Join("test.db", "00000000000000000000" + SegExt)
+        writeToFile(path, segmentHeaderSize + 2 * 34 - 1, []byte(`x`))
+        writeToFile(path, segmentHeaderSize + 4 * 34, []byte{0xff, 0xff, 0xff, 0x7f})
+        writeToFile(path, segmentHeaderSize + 5 * 34 - 1, []byte(`x`))
+
+        report, err := Verify("test.db", nil)
+        if err != nil || issueKinds(report)[IssueCorruptRecord] != 2 || issueKinds(report)[IssueTornTail] != 0 || report.Issues[0].Offset != 1 || report.Issues[1].Offset != 4 {
+                os.RemoveAll("test.db")
+                t.Fatalf("Expect corrupt records at offsets 1 and 4 but got: %v, %v", report.Issues, err)
+        }
+
+        if _, err := Repair("test.db", nil, false); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        if report, err = Verify("test.db", nil); err != nil || len(report.Issues) != 2 || issueKinds(report)[IssueCorruptRecord] != 2 || report.Segments[0].LastOffset != 6 {
+                t.Errorf("Expect the corrupt records to be kept but got: %v, %v", report.Issues, err)
+        }
+
+        cl, err = New("test.db", options)
+        if err != nil {
+                t.Error(err)
+        }
+        for _, offset := range []int{0, 2, 3, 6} {
+                if data, err := cl.Read(offset); err != nil || string(data) != `0123456789` {
+                        t.Errorf("Expect to read offset %v but got: %s, %v", offset, data, err)
+                }
+        }
+        if reports := cl.Recoveries(); len(reports) != 0 {
+                t.Errorf("Expect no recovery after the repair but got: %+v", reports[0])
+        }
+        if offset, err := cl.Append([]byte(`0123456789`)); err != nil || offset != 7 {
+                t.Errorf("Expect offset 7 but got: %v, %v", offset, err)
+        }
+        cl.Close()
+
+        if _, err := Repair("test.db", nil, true); err != nil {
+                t.Errorf("Expect nil error but got: %v", err)
+        }
+        report, err = Verify("test.db", nil)
+        if err != nil || len(report.Issues) != 0 || report.Segments[0].LastOffset != 0 {
+                t.Errorf("Expect the log file to be cut at offset 1 but got: %v, %+v, %v", report.Issues, report.Segments[0], err)
+        }
+        os.RemoveAll("test.db")
+}